@@ -3,17 +3,17 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"runtime"
 
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/controller"
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/installer"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/release"
 
 	k8sutil "github.com/operator-framework/operator-sdk/pkg/util/k8sutil"
 	sdkVersion "github.com/operator-framework/operator-sdk/version"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
-	"k8s.io/helm/pkg/storage"
-	"k8s.io/helm/pkg/storage/driver"
 
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -26,6 +26,13 @@ func printVersion() {
 	log.Printf("operator-sdk Version: %v", sdkVersion.Version)
 }
 
+var (
+	metricsAddr      = flag.String("metrics-addr", ":8383", "The address the metrics endpoint binds to, so Prometheus can scrape per-GVK reconcile counts, latency histograms, and failure counters.")
+	healthProbeAddr  = flag.String("health-probe-addr", ":8686", "The address the health and readiness probe endpoint binds to.")
+	leaderElection   = flag.Bool("leader-election", false, "Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	leaderElectionID = flag.String("leader-election-id", "helm-app-operator-lock", "Name of the configmap used to coordinate leader election between operator replicas.")
+)
+
 func main() {
 	printVersion()
 	flag.Parse()
@@ -35,9 +42,6 @@ func main() {
 		log.Fatalf("Failed to get watch namespace: %v", err)
 	}
 
-	// TODO: Expose metrics port after SDK uses controller-runtime's dynamic client
-	// sdk.ExposeMetricsPort()
-
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
@@ -45,34 +49,64 @@ func main() {
 	}
 
 	// Create a new Cmd to provide shared dependencies and start components
-	mgr, err := manager.New(cfg, manager.Options{Namespace: namespace})
+	mgr, err := manager.New(cfg, manager.Options{
+		Namespace:              namespace,
+		MetricsBindAddress:     *metricsAddr,
+		HealthProbeBindAddress: *healthProbeAddr,
+		LeaderElection:         *leaderElection,
+		LeaderElectionID:       *leaderElectionID,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Print("Registering Components.")
 
-	// Create Tiller's kubernetes client and storage backend to be shared
-	// across all helm installers.
+	// Create Tiller's kubernetes client to be shared across all helm
+	// installers. Each installer builds its own namespace-scoped Secrets
+	// storage backend on demand, so release state travels with the CR
+	// instead of being lost whenever this process restarts.
 	tillerKubeClient := installer.NewTillerClientFromManager(mgr)
-	storageBackend := storage.Init(driver.NewMemory())
 
 	// Dynamically load the CR watchers and helm installers based on the
 	// environment.
-	watches, err := installer.NewFromEnv(tillerKubeClient, storageBackend)
+	watches, err := installer.NewFromEnv(tillerKubeClient)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Register all of the watches with the manager.
 	done := signals.SetupSignalHandler()
-	for gvk, i := range watches {
-		controller.Add(mgr, controller.WatchOptions{
-			GVK:         gvk,
-			Namespace:   namespace,
-			Installer:   i,
-			StopChannel: done,
-		})
+	for gvk, w := range watches {
+		if err := controller.Add(mgr, controller.WatchOptions{
+			GVK:                     gvk,
+			Namespace:               namespace,
+			Installer:               w.Installer,
+			StopChannel:             done,
+			ReconcilePeriod:         w.Options.ReconcilePeriod,
+			MaxConcurrentReconciles: w.Options.MaxConcurrentReconciles,
+			WatchDependentResources: w.Options.WatchDependentResources,
+			OverrideValues:          w.Options.OverrideValues,
+			DependsOn:               w.DependsOn,
+			Order:                   w.Order,
+		}); err != nil {
+			// A bad GVK here shouldn't take down every other watch this
+			// operator manages, so log and keep going instead of Fatal.
+			log.Printf("failed to add controller for %s: %v", gvk, err)
+			continue
+		}
+	}
+
+	// If DynamicWatchesEnvVar is set, additionally manage its GVKs through a
+	// WatchRegistry, so those can be added or removed by editing the file on
+	// disk instead of restarting the pod. This is opt-in and additive: it
+	// only touches GVKs named in its own file, never the ones above.
+	if dynamicWatchesFile, ok := os.LookupEnv(release.DynamicWatchesEnvVar); ok {
+		registry := release.NewWatchRegistry(tillerKubeClient, dynamicWatchesFile, 0)
+		go controller.AddDynamic(mgr, registry, done)
+		if err := registry.Start(done); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	log.Print("Starting the Cmd.")
@@ -2,8 +2,8 @@ package controller
 
 import (
 	"fmt"
-	"log"
 	"strings"
+	"time"
 
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/installer"
 
@@ -14,6 +14,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
@@ -26,32 +27,72 @@ type WatchOptions struct {
 	// StopChannel is used to deal with the bug:
 	// https://github.com/kubernetes-sigs/controller-runtime/issues/103
 	StopChannel <-chan struct{}
+
+	// ReconcilePeriod, MaxConcurrentReconciles, WatchDependentResources, and
+	// OverrideValues come from the watch's ReconcileOptions and let each GVK
+	// tune its own controller instead of sharing one hardcoded reconcile
+	// loop.
+	ReconcilePeriod         time.Duration
+	MaxConcurrentReconciles int
+	WatchDependentResources bool
+	OverrideValues          map[string]string
+
+	// DependsOn lists other watched GVKs that must already have a Deployed
+	// release in a CR's namespace before that CR's release is installed or
+	// updated, and Order is this GVK's position in the dependency-resolved
+	// startup order. Both come from watches.yaml's dependsOn entries; see
+	// installer.WatchedGVK.
+	DependsOn []schema.GroupVersionKind
+	Order     int
 }
 
-// Add creates a new helm operator controller and adds it to the manager
-func Add(mgr manager.Manager, options WatchOptions) {
+// Add creates a new helm operator controller and adds it to the manager. It
+// returns an error rather than calling log.Fatal so that a bad GVK in one
+// watch doesn't take down every other controller the operator is running.
+func Add(mgr manager.Manager, options WatchOptions) error {
 	hor := &helmOperatorReconciler{
-		Client:    mgr.GetClient(),
-		GVK:       options.GVK,
-		Installer: options.Installer,
+		Client:          mgr.GetClient(),
+		GVK:             options.GVK,
+		Installer:       options.Installer,
+		ReconcilePeriod: options.ReconcilePeriod,
+		Log:             defaultLog.WithValues("gvk", options.GVK),
+		StopChannel:     options.StopChannel,
+		DependsOn:       options.DependsOn,
+		Order:           options.Order,
+		OverrideValues:  options.OverrideValues,
 	}
 
 	// Register the GVK with the schema
 	mgr.GetScheme().AddKnownTypeWithName(options.GVK, &unstructured.Unstructured{})
 	metav1.AddToGroupVersion(mgr.GetScheme(), options.GVK.GroupVersion())
 
+	maxConcurrentReconciles := options.MaxConcurrentReconciles
+	if maxConcurrentReconciles <= 0 {
+		maxConcurrentReconciles = 1
+	}
+
 	// Create new controller-runtime controller and set the controller to watch this GVK.
 	c, err := controller.New(fmt.Sprintf("%v-controller", strings.ToLower(options.GVK.Kind)), mgr, controller.Options{
-		Reconciler: hor,
+		Reconciler:              hor,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	u := &unstructured.Unstructured{}
 	u.SetGroupVersionKind(options.GVK)
-	if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}); err != nil {
-		log.Fatal(err)
+	// GenerationChangedPredicate drops UpdateEvents where spec (and
+	// therefore metadata.generation) didn't change, so updateResourceStatus
+	// writing status back onto the CR doesn't trigger another reconcile of
+	// its own.
+	if err := c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}, predicate.GenerationChangedPredicate{}); err != nil {
+		return err
+	}
+
+	if options.WatchDependentResources {
+		hor.dependents = newDependentResourceWatcher(c, mgr, options.GVK, options.Namespace != "")
 	}
 
-	log.Printf("Watching %s, %s", options.GVK, options.Namespace)
+	hor.Log.Info("Watching resource", "namespace", options.Namespace)
+	return nil
 }
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// dependentResourceWatcher registers, on demand, a watch for every GVK
+// rendered by a chart's manifest, so edits made directly to a dependent
+// resource (e.g. `kubectl edit configmap`) trigger a reconcile of the owning
+// CR without waiting on the periodic reconcileLoop. Registrations are
+// refcounted per GVK: every watchGVKs call (made once per successful
+// reconcile) adds a reference and every release call (made once per
+// uninstall) drops one, so the count tracks calls, not distinct CRs. Since
+// controller-runtime provides no way to unwatch a source once added, release
+// only decrements the refcount; the underlying watch itself persists for the
+// life of the controller and is never registered twice.
+type dependentResourceWatcher struct {
+	controller crcontroller.Controller
+	mgr        manager.Manager
+	ownerGVK   schema.GroupVersionKind
+	namespaced bool
+
+	mu       sync.Mutex
+	refcount map[schema.GroupVersionKind]int
+}
+
+func newDependentResourceWatcher(c crcontroller.Controller, mgr manager.Manager, ownerGVK schema.GroupVersionKind, namespaced bool) *dependentResourceWatcher {
+	return &dependentResourceWatcher{
+		controller: c,
+		mgr:        mgr,
+		ownerGVK:   ownerGVK,
+		namespaced: namespaced,
+		refcount:   map[schema.GroupVersionKind]int{},
+	}
+}
+
+// watchGVKs registers a watch for each of gvks that isn't already watched,
+// skipping cluster-scoped kinds when the operator itself is namespace-scoped.
+func (w *dependentResourceWatcher) watchGVKs(gvks []schema.GroupVersionKind) error {
+	for _, gvk := range gvks {
+		if err := w.watch(gvk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *dependentResourceWatcher) watch(gvk schema.GroupVersionKind) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.refcount[gvk]; ok {
+		w.refcount[gvk]++
+		return nil
+	}
+
+	if w.namespaced {
+		mapping, err := w.mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return fmt.Errorf("failed to get REST mapping for %v: %v", gvk, err)
+		}
+		if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+			return nil
+		}
+	}
+
+	owner := &unstructured.Unstructured{}
+	owner.SetGroupVersionKind(w.ownerGVK)
+
+	dependent := &unstructured.Unstructured{}
+	dependent.SetGroupVersionKind(gvk)
+	if err := w.controller.Watch(&source.Kind{Type: dependent}, &crthandler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    owner,
+	}); err != nil {
+		return fmt.Errorf("failed to watch dependent resource %v: %v", gvk, err)
+	}
+
+	w.refcount[gvk] = 1
+	return nil
+}
+
+// release drops one reference to each of gvks, recorded when a CR that
+// rendered them is uninstalled.
+func (w *dependentResourceWatcher) release(gvks []schema.GroupVersionKind) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, gvk := range gvks {
+		if w.refcount[gvk] > 0 {
+			w.refcount[gvk]--
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync/atomic"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/release"
+)
+
+// AddDynamic subscribes to registry and, for as long as stop is open,
+// installs a new HelmOperatorReconciler for every WatchAdded event and
+// deactivates the corresponding one on every WatchRemoved event, so cluster
+// admins can extend (or retire) the GVKs this operator manages by editing
+// the watches file, without restarting the pod.
+//
+// "Deactivates" rather than "removes": the vendored controller-runtime here
+// has no API to tear down a controller's watch once registered, so a
+// removed GVK's reconciler is flipped to a permanent no-op instead. Its
+// controller-runtime watch keeps receiving events, but Reconcile returns
+// immediately without touching Tiller or the CR's status.
+func AddDynamic(mgr manager.Manager, registry *release.WatchRegistry, stop <-chan struct{}) {
+	active := map[string]*int32{}
+	for event := range registry.Events() {
+		key := event.GVK.String()
+		switch event.Type {
+		case release.WatchAdded:
+			flag := new(int32)
+			*flag = 1
+			active[key] = flag
+			hor := &HelmOperatorReconciler{
+				Client:         mgr.GetClient(),
+				GVK:            event.GVK,
+				ManagerFactory: event.Factory,
+				StopChannel:    stop,
+				active:         flag,
+			}
+			if err := hor.SetupWithManager(mgr); err != nil {
+				defaultLog.Error(err, "Failed to add dynamic controller", "gvk", event.GVK)
+				continue
+			}
+			defaultLog.Info("Added dynamic controller", "gvk", event.GVK)
+		case release.WatchRemoved:
+			if flag, ok := active[key]; ok {
+				atomic.StoreInt32(flag, 0)
+				delete(active, key)
+			}
+			defaultLog.Info("Deactivated dynamic controller", "gvk", event.GVK)
+		}
+	}
+}
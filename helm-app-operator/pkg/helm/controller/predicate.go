@@ -0,0 +1,69 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// managedAnnotationPrefix marks the annotation keys a CR's owner sets to
+// configure a release.Manager (see release.DefaultAnnotationSet). A change
+// confined to these annotations only ever affects the *next* install or
+// update, so it doesn't need its own reconcile.
+const managedAnnotationPrefix = "helm.sdk.operatorframework.io/"
+
+// ignoreManagedFieldsUpdates is a predicate.Predicate that drops UpdateEvents
+// where the only thing that changed is .status, .metadata.resourceVersion, or
+// a managedAnnotationPrefix annotation. Without it, updateResourceStatus's
+// own write to the watched resource generates another UpdateEvent, which
+// reconciles again, writes status again, and so on — a self-triggering loop
+// bounded only by however long ResyncPeriod happens to take to line up with a
+// truly no-op pass.
+var ignoreManagedFieldsUpdates = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldObj, ok := e.ObjectOld.(*unstructured.Unstructured)
+		newObj, ok2 := e.ObjectNew.(*unstructured.Unstructured)
+		if !ok || !ok2 {
+			return true
+		}
+		return !reflect.DeepEqual(reconcileFingerprint(oldObj), reconcileFingerprint(newObj))
+	},
+}
+
+// reconcileFingerprint returns a copy of u's object map with the fields
+// Reconcile itself is responsible for (.status and .metadata.resourceVersion)
+// cleared, and with managedAnnotationPrefix annotations stripped, so two
+// fingerprints are equal iff nothing outside of those changed.
+func reconcileFingerprint(u *unstructured.Unstructured) map[string]interface{} {
+	cp := u.DeepCopy()
+	delete(cp.Object, "status")
+	cp.SetResourceVersion("")
+
+	annotations := cp.GetAnnotations()
+	for key := range annotations {
+		if strings.HasPrefix(key, managedAnnotationPrefix) {
+			delete(annotations, key)
+		}
+	}
+	cp.SetAnnotations(annotations)
+
+	return cp.Object
+}
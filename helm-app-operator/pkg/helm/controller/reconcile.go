@@ -16,63 +16,158 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/go-logr/logr"
 
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	rpb "k8s.io/helm/pkg/proto/hapi/release"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/types"
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/util"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/metrics"
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/release"
 )
 
+// helmAppConditionTypes lists every HelmAppConditionType the reconciler sets,
+// so syncConditionMetrics can clear the gauge for types a CR no longer
+// reports as well as set it for ones it does.
+var helmAppConditionTypes = []types.HelmAppConditionType{
+	types.ConditionInitializing,
+	types.ConditionIrreconcilable,
+	types.ConditionReleaseFailed,
+	types.ConditionDeployed,
+	types.ConditionUninstalling,
+}
+
 var _ reconcile.Reconciler = &HelmOperatorReconciler{}
 
+// defaultLog is used by Reconcile whenever Log is left unset.
+var defaultLog = logf.Log.WithName("helm.controller")
+
 // HelmOperatorReconciler reconciles custom resources as Helm releases.
 type HelmOperatorReconciler struct {
 	Client         client.Client
 	GVK            schema.GroupVersionKind
 	ManagerFactory release.ManagerFactory
 	ResyncPeriod   time.Duration
+
+	// Log receives structured reconcile events. If nil, a logger named
+	// "helm.controller" off the controller-runtime default is used.
+	Log logr.Logger
+	// Recorder, if set, records Kubernetes Events on the reconciled CR for
+	// install/update/uninstall successes and failures, so `kubectl describe`
+	// shows meaningful history beyond the terse HelmAppCondition.
+	Recorder record.EventRecorder
+	// Metrics receives Helm action and HelmAppCondition observations. If nil,
+	// metrics.Default is used.
+	Metrics *metrics.Metrics
+
+	// StopChannel, if set, is closed when the operator is shutting down.
+	// Reconcile derives its context from it, so a SIGTERM cancels any
+	// in-flight PrepareRelease/InstallRelease/UpdateRelease call instead of
+	// leaving a half-installed release for the existing purge/rollback code
+	// paths to clean up on the next run, the way `helm install --atomic`
+	// handles its own SIGTERM.
+	StopChannel <-chan struct{}
+
+	// active, if non-nil, is checked at the top of Reconcile; a value of 0
+	// makes Reconcile a no-op. AddDynamic uses this as a soft "stop" for a
+	// GVK removed from the watches file, since controller-runtime (at the
+	// vendored version this operator builds against) has no API to tear
+	// down an already-registered controller's watch.
+	active *int32
+}
+
+// isActive reports whether Reconcile should do anything, treating a nil
+// active flag (the common case, set by every caller except AddDynamic) as
+// always active.
+func (r *HelmOperatorReconciler) isActive() bool {
+	return r.active == nil || atomic.LoadInt32(r.active) != 0
 }
 
 const (
 	finalizer = "uninstall-helm-release"
 )
 
+// SetupWithManager creates a controller-runtime controller for r.GVK backed
+// by r and registers it with mgr, filtering out the self-triggering
+// UpdateEvents that updateResourceStatus's own writes would otherwise cause
+// via ignoreManagedFieldsUpdates.
+func (r *HelmOperatorReconciler) SetupWithManager(mgr manager.Manager) error {
+	c, err := controller.New(fmt.Sprintf("%v-controller", strings.ToLower(r.GVK.Kind)), mgr, controller.Options{
+		Reconciler: r,
+	})
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(r.GVK)
+	return c.Watch(&source.Kind{Type: u}, &crthandler.EnqueueRequestForObject{}, ignoreManagedFieldsUpdates)
+}
+
 // Reconcile reconciles the requested resource by installing, updating, or
 // uninstalling a Helm release based on the resource's current state. If no
 // release changes are necessary, Reconcile will create or patch the underlying
 // resources to match the expected release manifest.
 func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	if !r.isActive() {
+		return reconcile.Result{}, nil
+	}
+
+	log := r.Log
+	if log == nil {
+		log = defaultLog
+	}
+	log = log.WithValues("namespace", request.Namespace, "name", request.Name, "gvk", r.GVK)
+
 	o := &unstructured.Unstructured{}
 	o.SetGroupVersionKind(r.GVK)
 	o.SetNamespace(request.Namespace)
 	o.SetName(request.Name)
-	logrus.Debugf("Processing %s", util.ResourceString(o))
+	log.V(1).Info("Processing resource")
 
 	err := r.Client.Get(context.TODO(), request.NamespacedName, o)
 	if apierrors.IsNotFound(err) {
 		return reconcile.Result{}, nil
 	}
 	if err != nil {
-		logrus.Errorf("failed to lookup %s: %s", util.ResourceString(o), err)
+		log.Error(err, "Failed to look up resource")
 		return reconcile.Result{}, err
 	}
 
-	manager := r.ManagerFactory.NewManager(o)
+	ctx, cancel := r.contextFor(o)
+	defer cancel()
+
+	manager, err := r.ManagerFactory.NewManager(o)
+	if err != nil {
+		log.Error(err, "Failed to get release manager")
+		return reconcile.Result{}, err
+	}
 	status := types.StatusFor(o)
 	releaseName := manager.ReleaseName()
+	log = log.WithValues("release", releaseName)
 
 	deleted := o.GetDeletionTimestamp() != nil
 	pendingFinalizers := o.GetFinalizers()
 	if !deleted && !contains(pendingFinalizers, finalizer) {
-		logrus.Debugf("Adding finalizer \"%s\" to %s", finalizer, util.ResourceString(o))
+		log.V(1).Info("Adding finalizer", "finalizer", finalizer)
 		finalizers := append(pendingFinalizers, finalizer)
 		o.SetFinalizers(finalizers)
 		if len(status.Conditions) == 0 {
@@ -81,13 +176,27 @@ func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.
 				Status: types.StatusTrue,
 			})
 		}
+		r.syncConditionMetrics(o, status)
 		err := r.Client.Update(context.TODO(), o)
 		return reconcile.Result{}, err
 	}
 	status.RemoveCondition(types.ConditionInitializing)
 
-	if err := manager.Sync(context.TODO()); err != nil {
-		logrus.Errorf("failed to sync release for %s release=%s: %s", util.ResourceString(o), releaseName, err)
+	if !deleted {
+		if releaseStatus, description, err := manager.ReleaseStatus(ctx); err != nil {
+			log.Error(err, "Failed to get release status")
+		} else if releaseStatus.GetCode() == rpb.Status_FAILED {
+			status.SetCondition(types.HelmAppCondition{
+				Type:    types.ConditionReleaseFailed,
+				Status:  types.StatusTrue,
+				Reason:  types.ReasonReconcileError,
+				Message: description,
+			})
+		}
+	}
+
+	if err := manager.Sync(ctx); err != nil {
+		log.Error(err, "Failed to sync release")
 		status.SetCondition(types.HelmAppCondition{
 			Type:    types.ConditionIrreconcilable,
 			Status:  types.StatusTrue,
@@ -101,12 +210,13 @@ func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.
 
 	if deleted {
 		if !contains(pendingFinalizers, finalizer) {
-			logrus.Infof("Resource %s is terminated, skipping reconciliation", util.ResourceString(o))
+			log.Info("Resource is terminated, skipping reconciliation")
 			return reconcile.Result{}, nil
 		}
 
-		uninstalledRelease, err := manager.UninstallRelease(context.TODO())
+		uninstalledRelease, err := manager.UninstallRelease(ctx)
 		if err != nil && err != release.ErrNotFound {
+			log.Error(err, "Failed to uninstall release")
 			status.SetCondition(types.HelmAppCondition{
 				Type:    types.ConditionReleaseFailed,
 				Status:  types.StatusTrue,
@@ -114,20 +224,37 @@ func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.
 				Message: err.Error(),
 			})
 			_ = r.updateResourceStatus(o, status)
+			r.event(o, corev1.EventTypeWarning, "UninstallFailed", "Failed to uninstall release %s: %s", releaseName, err)
 			return reconcile.Result{}, err
 		}
 		status.RemoveCondition(types.ConditionReleaseFailed)
 
 		if err == release.ErrNotFound {
-			logrus.Infof("Release %s for resource %s not found, removing finalizer", releaseName, util.ResourceString(o))
+			log.Info("Release not found, removing finalizer")
 		} else {
 			diff := util.Diff(uninstalledRelease.GetManifest(), "")
-			logrus.Infof("Uninstalled release for %s release=%s; diff:\n%s", util.ResourceString(o), releaseName, diff)
+			log.Info("Uninstalled release", "diff", diff)
 			status.SetCondition(types.HelmAppCondition{
 				Type:   types.ConditionDeployed,
 				Status: types.StatusFalse,
 				Reason: types.ReasonUninstallSuccessful,
 			})
+			status.SetDeployedRelease(nil)
+			r.event(o, corev1.EventTypeNormal, "UninstallSuccessful", "Uninstalled release %s", releaseName)
+
+			if manager.UninstallWaitEnabled() {
+				awaitingRemoval, err := manager.AwaitingDependentResourceRemoval(ctx, uninstalledRelease.GetManifest())
+				if err != nil {
+					log.Error(err, "Failed to check dependent resources")
+					_ = r.updateResourceStatus(o, status)
+					return reconcile.Result{}, err
+				}
+				if awaitingRemoval {
+					log.Info("Waiting for dependent resources to be removed before removing finalizer")
+					_ = r.updateResourceStatus(o, status)
+					return reconcile.Result{RequeueAfter: r.ResyncPeriod}, nil
+				}
+			}
 		}
 		finalizers := []string{}
 		for _, pendingFinalizer := range pendingFinalizers {
@@ -136,71 +263,91 @@ func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.
 			}
 		}
 		o.SetFinalizers(finalizers)
+		r.syncConditionMetrics(o, status)
 		err = r.Client.Update(context.TODO(), o)
 		return reconcile.Result{}, err
 	}
 
+	if err := manager.PrepareRelease(ctx); err != nil {
+		log.Error(err, "Failed to prepare release")
+		status.SetCondition(types.HelmAppCondition{
+			Type:    types.ConditionIrreconcilable,
+			Status:  types.StatusTrue,
+			Reason:  types.ReasonReconcileError,
+			Message: err.Error(),
+		})
+		_ = r.updateResourceStatus(o, status)
+		return reconcile.Result{}, err
+	}
+	status.RemoveCondition(types.ConditionIrreconcilable)
+
 	if !manager.IsInstalled() {
-		installedRelease, err := manager.InstallRelease(context.TODO())
+		installedRelease, err := manager.InstallRelease(ctx)
 		if err != nil {
-			logrus.Errorf("failed to install release for %s release=%s: %s", util.ResourceString(o), releaseName, err)
+			log.Error(err, "Failed to install release")
 			status.SetCondition(types.HelmAppCondition{
 				Type:    types.ConditionReleaseFailed,
 				Status:  types.StatusTrue,
 				Reason:  types.ReasonInstallError,
 				Message: err.Error(),
-				Release: installedRelease,
+				Release: releaseInfo(installedRelease),
 			})
 			_ = r.updateResourceStatus(o, status)
+			r.event(o, corev1.EventTypeWarning, "InstallFailed", "Failed to install release %s: %s", releaseName, err)
 			return reconcile.Result{}, err
 		}
 		status.RemoveCondition(types.ConditionReleaseFailed)
 
 		diff := util.Diff("", installedRelease.GetManifest())
-		logrus.Infof("Installed release for %s release=%s; diff:\n%s", util.ResourceString(o), releaseName, diff)
+		log.Info("Installed release", "chartVersion", installedRelease.GetChartVersion(), "diff", diff)
 		status.SetCondition(types.HelmAppCondition{
 			Type:    types.ConditionDeployed,
 			Status:  types.StatusTrue,
 			Reason:  types.ReasonInstallSuccessful,
-			Message: installedRelease.GetInfo().GetStatus().GetNotes(),
-			Release: installedRelease,
+			Message: installedRelease.GetNotes(),
+			Release: releaseInfo(installedRelease),
 		})
+		status.SetDeployedRelease(releaseInfo(installedRelease))
+		r.event(o, corev1.EventTypeNormal, "InstallSuccessful", "Installed release %s", releaseName)
 		err = r.updateResourceStatus(o, status)
 		return reconcile.Result{RequeueAfter: r.ResyncPeriod}, err
 	}
 
 	if manager.IsUpdateRequired() {
-		previousRelease, updatedRelease, err := manager.UpdateRelease(context.TODO())
+		previousRelease, updatedRelease, err := manager.UpdateRelease(ctx)
 		if err != nil {
-			logrus.Errorf("failed to update release for %s release=%s: %s", util.ResourceString(o), releaseName, err)
+			log.Error(err, "Failed to update release")
 			status.SetCondition(types.HelmAppCondition{
 				Type:    types.ConditionReleaseFailed,
 				Status:  types.StatusTrue,
 				Reason:  types.ReasonUpdateError,
 				Message: err.Error(),
-				Release: updatedRelease,
+				Release: releaseInfo(updatedRelease),
 			})
 			_ = r.updateResourceStatus(o, status)
+			r.event(o, corev1.EventTypeWarning, "UpgradeFailed", "Failed to update release %s: %s", releaseName, err)
 			return reconcile.Result{}, err
 		}
 		status.RemoveCondition(types.ConditionReleaseFailed)
 
 		diff := util.Diff(previousRelease.GetManifest(), updatedRelease.GetManifest())
-		logrus.Infof("Updated release for %s release=%s; diff:\n%s", util.ResourceString(o), releaseName, diff)
+		log.Info("Updated release", "chartVersion", updatedRelease.GetChartVersion(), "diff", diff)
 		status.SetCondition(types.HelmAppCondition{
 			Type:    types.ConditionDeployed,
 			Status:  types.StatusTrue,
 			Reason:  types.ReasonUpdateSuccessful,
-			Message: updatedRelease.GetInfo().GetStatus().GetNotes(),
-			Release: updatedRelease,
+			Message: updatedRelease.GetNotes(),
+			Release: releaseInfo(updatedRelease),
 		})
+		status.SetDeployedRelease(releaseInfo(updatedRelease))
+		r.event(o, corev1.EventTypeNormal, "UpgradeSuccessful", "Updated release %s", releaseName)
 		err = r.updateResourceStatus(o, status)
 		return reconcile.Result{RequeueAfter: r.ResyncPeriod}, err
 	}
 
-	_, err = manager.ReconcileRelease(context.TODO())
+	_, diff, err := manager.ReconcileRelease(ctx)
 	if err != nil {
-		logrus.Errorf("failed to reconcile release for %s release=%s: %s", util.ResourceString(o), releaseName, err)
+		log.Error(err, "Failed to reconcile release")
 		status.SetCondition(types.HelmAppCondition{
 			Type:    types.ConditionIrreconcilable,
 			Status:  types.StatusTrue,
@@ -212,14 +359,93 @@ func (r HelmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.
 	}
 	status.RemoveCondition(types.ConditionIrreconcilable)
 
-	logrus.Infof("Reconciled release for %s release=%s", util.ResourceString(o), releaseName)
+	if diff != "" {
+		log.Info("Reconciled release", "diff", diff)
+		r.event(o, corev1.EventTypeNormal, "ReconcileDrift", "Corrected drift in release %s:\n%s", releaseName, diff)
+	} else {
+		log.V(1).Info("Reconciled release")
+	}
 	err = r.updateResourceStatus(o, status)
 	return reconcile.Result{RequeueAfter: r.ResyncPeriod}, err
 }
 
+// releaseInfo snapshots rel for embedding in a HelmAppCondition, returning
+// nil if rel is nil (e.g. an install/update that failed before Tiller or
+// Helm v3 returned anything).
+func releaseInfo(rel release.Release) *types.ReleaseInfo {
+	if rel == nil {
+		return nil
+	}
+	return rel.Info()
+}
+
+// event records a Kubernetes Event on o if a Recorder is configured; it is a
+// no-op otherwise so Recorder remains an optional field.
+func (r HelmOperatorReconciler) event(o runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(o, eventType, reason, messageFmt, args...)
+}
+
+// updateResourceStatus writes status onto o's status subresource, so the
+// write doesn't bump o's .metadata.generation or race a concurrent spec
+// update the way writing through the main resource would.
 func (r HelmOperatorReconciler) updateResourceStatus(o *unstructured.Unstructured, status *types.HelmAppStatus) error {
+	status.SetObservedGeneration(o.GetGeneration())
+	r.syncConditionMetrics(o, status)
 	o.Object["status"] = status
-	return r.Client.Update(context.TODO(), o)
+	return r.Client.Status().Update(context.TODO(), o)
+}
+
+// syncConditionMetrics moves the ReleaseCondition gauge for o onto the status
+// currently reported for each of helmAppConditionTypes, clearing the gauge
+// for any type status no longer reports.
+func (r HelmOperatorReconciler) syncConditionMetrics(o *unstructured.Unstructured, status *types.HelmAppStatus) {
+	m := r.Metrics
+	if m == nil {
+		m = metrics.Default
+	}
+	key := apitypes.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+	for _, conditionType := range helmAppConditionTypes {
+		conditionStatus := ""
+		if c := status.GetCondition(conditionType); c != nil {
+			conditionStatus = string(c.Status)
+		}
+		m.SetCondition(r.GVK, key, string(conditionType), conditionStatus)
+	}
+}
+
+// timeoutSecondsField is the spec field a CR can set to bound how long a
+// single Reconcile is allowed to run before its context is cancelled.
+const timeoutSecondsField = "timeoutSeconds"
+
+// contextFor returns the context.Context a single Reconcile call for o
+// should use for its Helm actions. It is cancelled when r.StopChannel
+// closes, and further bounded by o's spec.timeoutSeconds if set, so a
+// misbehaving chart can't wedge a reconcile loop forever. The caller must
+// invoke the returned CancelFunc to release resources.
+func (r HelmOperatorReconciler) contextFor(o *unstructured.Unstructured) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.StopChannel != nil {
+		stop := r.StopChannel
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	if timeoutSeconds, found, err := unstructured.NestedInt64(o.Object, "spec", timeoutSecondsField); err == nil && found && timeoutSeconds > 0 {
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		return timeoutCtx, func() {
+			timeoutCancel()
+			cancel()
+		}
+	}
+	return ctx, cancel
 }
 
 func contains(l []string, s string) bool {
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/installer"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/api"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/metrics"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ reconcile.Reconciler = &helmOperatorReconciler{}
+
+// helmOperatorReconciler reconciles a single GVK's custom resources as Helm
+// releases via an installer.Installer, adding a finalizer so UninstallRelease
+// runs before the CR is removed from the API server.
+type helmOperatorReconciler struct {
+	Client    client.Client
+	GVK       schema.GroupVersionKind
+	Installer installer.Installer
+
+	// ReconcilePeriod, if nonzero, requeues every successfully reconciled CR
+	// after this long, so drift is still caught between watch events
+	// (e.g. a resource the chart rendered was edited directly) even though
+	// GenerationChangedPredicate keeps status-only updates from triggering
+	// their own reconcile.
+	ReconcilePeriod time.Duration
+
+	// Log receives structured reconcile events. If nil, a logger named
+	// "helm.controller" off the controller-runtime default is used.
+	Log logr.Logger
+
+	// StopChannel, if set, is closed when the operator is shutting down.
+	// Reconcile derives its context from it, so a SIGTERM cancels any
+	// in-flight InstallRelease/UninstallRelease call instead of leaving it to
+	// run to completion. Per-release timeouts are the Installer's own
+	// responsibility (installer.DefaultTimeoutAnnotation).
+	StopChannel <-chan struct{}
+
+	// dependents is nil unless Add has wired up dependent-resource watching
+	// for this GVK.
+	dependents *dependentResourceWatcher
+
+	// Metrics receives Helm action and release-condition observations. If
+	// nil, metrics.Default is used.
+	Metrics *metrics.Metrics
+
+	// DependsOn lists other watched GVKs that must already have a Deployed
+	// release in this CR's namespace before Reconcile will install or
+	// update this CR's release. Order is this GVK's position in the
+	// dependency-resolved startup order, surfaced on the CR's status
+	// alongside WaitingOnDependencies.
+	DependsOn []schema.GroupVersionKind
+	Order     int
+
+	// OverrideValues are dotted-path chart values (e.g. "image.tag") forced
+	// onto every CR of this GVK before InstallRelease renders the chart,
+	// regardless of what the CR's own spec requests. They come from the
+	// watch's ReconcileOptions and are never persisted back onto the CR.
+	OverrideValues map[string]string
+}
+
+// dependencyWaitBackoff is how long Reconcile requeues a CR whose DependsOn
+// GVKs don't yet have a Deployed release in its namespace, rather than
+// busy-looping until they do.
+const dependencyWaitBackoff = 15 * time.Second
+
+// apiConditionTypes lists every api.ConditionType syncConditionMetrics
+// sets or clears the ReleaseCondition gauge for.
+var apiConditionTypes = []api.ConditionType{
+	api.ConditionInitialized,
+	api.ConditionIrreconcilable,
+	api.ConditionReleaseFailed,
+	api.ConditionDeployed,
+	api.ConditionUninstalling,
+}
+
+// metrics returns r.Metrics, falling back to metrics.Default.
+func (r *helmOperatorReconciler) metrics() *metrics.Metrics {
+	if r.Metrics != nil {
+		return r.Metrics
+	}
+	return metrics.Default
+}
+
+// syncConditionMetrics moves the ReleaseCondition gauge for o onto the
+// status currently reported for each of apiConditionTypes, clearing the
+// gauge for any type status no longer reports.
+func (r *helmOperatorReconciler) syncConditionMetrics(o *unstructured.Unstructured, status *api.HelmAppStatus) {
+	key := apitypes.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+	for _, conditionType := range apiConditionTypes {
+		conditionStatus := ""
+		for _, c := range status.Conditions {
+			if c.Type == conditionType {
+				conditionStatus = string(c.Status)
+				break
+			}
+		}
+		r.metrics().SetCondition(r.GVK, key, string(conditionType), conditionStatus)
+	}
+}
+
+// contextFor returns the context.Context Reconcile should use for its
+// Installer calls, cancelled when r.StopChannel closes. The caller must
+// invoke the returned CancelFunc to release resources.
+func (r *helmOperatorReconciler) contextFor() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.StopChannel != nil {
+		stop := r.StopChannel
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// unmetDependencies returns, as "<group>/<version>, Kind=<kind>" strings, the
+// subset of r.DependsOn that don't yet have at least one Deployed release
+// among the CRs of that GVK in namespace.
+func (r *helmOperatorReconciler) unmetDependencies(namespace string) ([]string, error) {
+	var unmet []string
+	for _, gvk := range r.DependsOn {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk)
+		if err := r.Client.List(context.TODO(), &client.ListOptions{Namespace: namespace}, list); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %s", gvk, err)
+		}
+
+		deployed := false
+		for i := range list.Items {
+			status := api.StatusFor(&list.Items[i])
+			for _, c := range status.Conditions {
+				if c.Type == api.ConditionDeployed && c.Status == api.ConditionStatusTrue {
+					deployed = true
+					break
+				}
+			}
+			if deployed {
+				break
+			}
+		}
+		if !deployed {
+			unmet = append(unmet, gvk.String())
+		}
+	}
+	return unmet, nil
+}
+
+// Reconcile installs, updates, or uninstalls the Helm release backing the
+// requested resource, registering watches on any dependent resources its
+// chart rendered so future drift is caught without periodic polling.
+func (r *helmOperatorReconciler) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	log := r.Log
+	if log == nil {
+		log = defaultLog
+	}
+	log = log.WithValues("namespace", request.Namespace, "name", request.Name, "gvk", r.GVK)
+
+	ctx, cancel := r.contextFor()
+	defer cancel()
+
+	o := &unstructured.Unstructured{}
+	o.SetGroupVersionKind(r.GVK)
+
+	err := r.Client.Get(context.TODO(), request.NamespacedName, o)
+	if apierrors.IsNotFound(err) {
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		log.Error(err, "Failed to look up resource")
+		return reconcile.Result{}, err
+	}
+
+	pendingFinalizers := o.GetFinalizers()
+	if o.GetDeletionTimestamp() != nil {
+		if !contains(pendingFinalizers, finalizer) {
+			return reconcile.Result{}, nil
+		}
+
+		if gvks, gvkErr := r.Installer.DependentResourceGVKs(o); gvkErr == nil && r.dependents != nil {
+			r.dependents.release(gvks)
+		}
+
+		// Captured before UninstallRelease purges this release from the
+		// storage backend, so it's still available for the
+		// AwaitingDependentResourceRemoval check below.
+		deployedManifest, err := r.Installer.DeployedManifest(o)
+		if err != nil {
+			log.Error(err, "Failed to look up deployed manifest")
+			return reconcile.Result{}, err
+		}
+
+		uninstallStart := time.Now()
+		o, err = r.Installer.UninstallRelease(ctx, o)
+		r.metrics().ObserveAction(r.GVK, metrics.ActionUninstall, uninstallStart, err)
+		if err != nil {
+			log.Error(err, "Failed to uninstall release")
+			r.syncConditionMetrics(o, api.StatusFor(o))
+			_ = r.Client.Update(context.TODO(), o)
+			return reconcile.Result{}, err
+		}
+		log.Info("Uninstalled release")
+		r.syncConditionMetrics(o, api.StatusFor(o))
+
+		if r.Installer.UninstallWaitEnabled(o) {
+			awaitingRemoval, err := r.Installer.AwaitingDependentResourceRemoval(ctx, o, deployedManifest)
+			if err != nil {
+				log.Error(err, "Failed to check dependent resources")
+				return reconcile.Result{}, err
+			}
+			if awaitingRemoval {
+				log.Info("Waiting for dependent resources to be removed before removing finalizer")
+				return reconcile.Result{RequeueAfter: r.ReconcilePeriod}, r.Client.Update(context.TODO(), o)
+			}
+		}
+
+		o.SetFinalizers(removeString(pendingFinalizers, finalizer))
+		return reconcile.Result{}, r.Client.Update(context.TODO(), o)
+	}
+
+	if !contains(pendingFinalizers, finalizer) {
+		o.SetFinalizers(append(pendingFinalizers, finalizer))
+		if err := r.Client.Update(context.TODO(), o); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if len(r.DependsOn) > 0 {
+		unmet, err := r.unmetDependencies(request.Namespace)
+		if err != nil {
+			log.Error(err, "Failed to check dependencies")
+			return reconcile.Result{}, err
+		}
+		status := api.StatusFor(o)
+		status.SetDependencyOrder(r.Order)
+		status.SetWaitingOnDependencies(unmet)
+		o.Object["status"] = status
+		if len(unmet) > 0 {
+			log.Info("Waiting on dependencies", "dependsOn", unmet)
+			if err := r.Client.Update(context.TODO(), o); err != nil {
+				return reconcile.Result{}, err
+			}
+			return reconcile.Result{RequeueAfter: dependencyWaitBackoff}, nil
+		}
+	}
+
+	// installTarget carries r.OverrideValues into the rendered chart without
+	// persisting them onto the CR's own spec: InstallRelease is given a copy
+	// to render from, and only its resulting status is copied back onto o
+	// before o is Update()d.
+	installTarget := o
+	if len(r.OverrideValues) > 0 {
+		installTarget = o.DeepCopy()
+		if err := applyOverrideValues(installTarget, r.OverrideValues); err != nil {
+			log.Error(err, "Failed to apply override values")
+			return reconcile.Result{}, err
+		}
+	}
+
+	// InstallRelease installs or updates the release in a single call, so
+	// ActionReconcile (rather than ActionInstall/ActionUpgrade) is the
+	// accurate label for what this call actually does.
+	applyStart := time.Now()
+	installResult, err := r.Installer.InstallRelease(ctx, installTarget)
+	r.metrics().ObserveAction(r.GVK, metrics.ActionReconcile, applyStart, err)
+	o.Object["status"] = installResult.Object["status"]
+	if err != nil {
+		log.Error(err, "Failed to apply release")
+		r.syncConditionMetrics(o, api.StatusFor(o))
+		_ = r.Client.Update(context.TODO(), o)
+		return reconcile.Result{}, err
+	}
+	r.syncConditionMetrics(o, api.StatusFor(o))
+	if rel := api.StatusFor(o).Release; rel != nil {
+		log.Info("Applied release",
+			"release", rel.GetName(),
+			"chart", rel.GetChart().GetMetadata().GetName(),
+			"revision", rel.GetVersion())
+	}
+
+	if r.dependents != nil {
+		gvks, gvkErr := r.Installer.DependentResourceGVKs(o)
+		if gvkErr != nil {
+			log.Error(gvkErr, "Failed to determine dependent resources")
+		} else if err := r.dependents.watchGVKs(gvks); err != nil {
+			log.Error(err, "Failed to watch dependent resources")
+		}
+	}
+
+	if err := r.Client.Update(context.TODO(), o); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: r.ReconcilePeriod}, nil
+}
+
+// applyOverrideValues sets each dotted-path key in overrides (e.g.
+// "image.tag") onto u's spec, creating intermediate maps as needed.
+func applyOverrideValues(u *unstructured.Unstructured, overrides map[string]string) error {
+	spec, _, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		return fmt.Errorf("failed reading spec: %s", err)
+	}
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+	for path, value := range overrides {
+		if err := unstructured.SetNestedField(spec, value, strings.Split(path, ".")...); err != nil {
+			return fmt.Errorf("failed setting override value %q: %s", path, err)
+		}
+	}
+	return unstructured.SetNestedMap(u.Object, spec, "spec")
+}
+
+func removeString(l []string, s string) []string {
+	out := make([]string, 0, len(l))
+	for _, elem := range l {
+		if elem != s {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
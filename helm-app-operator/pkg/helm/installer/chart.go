@@ -0,0 +1,212 @@
+package installer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/downloader"
+	"k8s.io/helm/pkg/getter"
+	helmenv "k8s.io/helm/pkg/helm/environment"
+)
+
+const (
+	// HelmChartCacheDirEnvVar overrides the directory used to cache charts
+	// that are resolved from a remote source (an HTTP repo, OCI registry,
+	// or git ref) instead of a local directory baked into the image.
+	HelmChartCacheDirEnvVar = "HELM_CHART_CACHE_DIR"
+
+	defaultChartCacheDir = "/opt/helm/chart-cache"
+
+	ociPrefix = "oci://"
+	gitPrefix = "git+https://"
+)
+
+// resolveChartDir returns a local directory containing the chart described
+// by w, downloading and caching it first if w names a remote source. Charts
+// that are already local directory paths are returned unchanged.
+func resolveChartDir(w watch) (string, error) {
+	cacheDir := chartCacheDir()
+
+	switch {
+	case w.Repo != "":
+		return fetchFromRepo(w.Repo, w.Chart, w.ChartVersion, cacheDir)
+	case strings.HasPrefix(w.Chart, ociPrefix):
+		return fetchOCIChart(strings.TrimPrefix(w.Chart, ociPrefix), w.ChartPullSecret, cacheDir)
+	case strings.HasPrefix(w.Chart, gitPrefix):
+		return fetchGitChart(strings.TrimPrefix(w.Chart, "git+"), cacheDir)
+	default:
+		return w.Chart, nil
+	}
+}
+
+// chartSource supplies the local directory an installer loads its chart
+// from. ChartDir returns the most recently resolved directory; if
+// refreshInterval was set, a background goroutine periodically calls
+// resolveChartDir again and swaps its result in. resolveChartDir returns an
+// existing cache entry for the same reference without fetching, so a moved
+// reference (a git branch, a floating repo version range) is picked up only
+// after its cache entry has been removed; the refresh itself does not pull
+// or re-download anything.
+type chartSource struct {
+	dir atomic.Value // string
+}
+
+// newChartSource resolves w's chart once and returns a chartSource serving
+// it, refreshing it every refreshInterval in the background if nonzero.
+func newChartSource(w watch, refreshInterval time.Duration) (*chartSource, error) {
+	dir, err := resolveChartDir(w)
+	if err != nil {
+		return nil, err
+	}
+	cs := &chartSource{}
+	cs.dir.Store(dir)
+	if refreshInterval > 0 {
+		go cs.refreshLoop(w, refreshInterval)
+	}
+	return cs, nil
+}
+
+func (c *chartSource) refreshLoop(w watch, refreshInterval time.Duration) {
+	for range time.Tick(refreshInterval) {
+		dir, err := resolveChartDir(w)
+		if err != nil {
+			log.Printf("failed refreshing chart %s: %s", w.Chart, err)
+			continue
+		}
+		c.dir.Store(dir)
+	}
+}
+
+// ChartDir returns the directory installer should currently load the chart
+// from.
+func (c *chartSource) ChartDir() string {
+	return c.dir.Load().(string)
+}
+
+func chartCacheDir() string {
+	if dir := os.Getenv(HelmChartCacheDirEnvVar); dir != "" {
+		return dir
+	}
+	return defaultChartCacheDir
+}
+
+// cacheDirFor returns a digest-keyed cache directory for the given chart
+// reference, so repeated resolutions of the same chart+version reuse the
+// cache instead of re-downloading on every operator restart.
+func cacheDirFor(cacheDir, ref string) string {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(ref)))
+	return filepath.Join(cacheDir, digest)
+}
+
+func isCached(dest string) bool {
+	entries, err := ioutil.ReadDir(dest)
+	return err == nil && len(entries) > 0
+}
+
+// fetchFromRepo downloads chartName at chartVersion from the given Helm
+// chart repository URL, verifying the chart's provenance file if one is
+// published alongside it.
+func fetchFromRepo(repoURL, chartName, chartVersion, cacheDir string) (string, error) {
+	dest := cacheDirFor(cacheDir, fmt.Sprintf("%s/%s@%s", repoURL, chartName, chartVersion))
+	if entries, err := ioutil.ReadDir(filepath.Join(dest, "expanded")); err == nil && len(entries) == 1 {
+		return filepath.Join(dest, "expanded", entries[0].Name()), nil
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", fmt.Errorf("failed to create chart cache dir: %s", err)
+	}
+
+	dl := downloader.ChartDownloader{
+		Out:     os.Stdout,
+		Getters: getter.All(helmenv.EnvSettings{}),
+	}
+	chartRef := fmt.Sprintf("%s/%s", repoURL, chartName)
+	archive, verification, err := dl.DownloadTo(chartRef, chartVersion, dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to download chart %s (version %s) from %s: %s", chartName, chartVersion, repoURL, err)
+	}
+	if verification != nil {
+		log.Printf("verified provenance for chart %s: %s", chartName, verification.FileHash)
+	}
+
+	return extractChart(archive)
+}
+
+// fetchOCIChart pulls a chart from an OCI registry given a reference of the
+// form "registry/path:tag". It shells out to the helm CLI's experimental
+// `chart` commands, which is how Helm v2 itself implements OCI support.
+func fetchOCIChart(ref, pullSecret, cacheDir string) (string, error) {
+	dest := cacheDirFor(cacheDir, ociPrefix+ref)
+	if isCached(dest) {
+		return dest, nil
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", fmt.Errorf("failed to create chart cache dir: %s", err)
+	}
+
+	pullArgs := []string{"chart", "pull", ref}
+	if pullSecret != "" {
+		pullArgs = append(pullArgs, "--config", pullSecret)
+	}
+	if out, err := exec.Command("helm", pullArgs...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to pull OCI chart %s: %s: %s", ref, err, out)
+	}
+
+	exportArgs := []string{"chart", "export", ref, "--destination", dest}
+	if out, err := exec.Command("helm", exportArgs...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to export OCI chart %s: %s: %s", ref, err, out)
+	}
+
+	return dest, nil
+}
+
+// fetchGitChart clones a chart's source repository from a "https://..." git
+// URL, optionally suffixed with "#<ref>" to pin a branch or tag, into the
+// cache directory.
+func fetchGitChart(gitURL, cacheDir string) (string, error) {
+	repoURL := gitURL
+	ref := ""
+	if idx := strings.Index(gitURL, "#"); idx >= 0 {
+		repoURL = gitURL[:idx]
+		ref = gitURL[idx+1:]
+	}
+
+	dest := cacheDirFor(cacheDir, "git+"+gitURL)
+	if isCached(dest) {
+		return dest, nil
+	}
+
+	cloneArgs := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		cloneArgs = append(cloneArgs, "--branch", ref)
+	}
+	cloneArgs = append(cloneArgs, repoURL, dest)
+	if out, err := exec.Command("git", cloneArgs...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to clone chart repo %s: %s: %s", repoURL, err, out)
+	}
+
+	return dest, nil
+}
+
+// extractChart loads the downloaded archive and expands it into a sibling
+// directory so that it can be reloaded with chartutil.LoadDir on every
+// reconcile, the same way a locally-mounted chart directory would be.
+func extractChart(archive string) (string, error) {
+	c, err := chartutil.Load(archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to load downloaded chart %s: %s", archive, err)
+	}
+	expandDir := filepath.Join(filepath.Dir(archive), "expanded")
+	if err := chartutil.SaveDir(c, expandDir); err != nil {
+		return "", fmt.Errorf("failed to expand chart into %s: %s", expandDir, err)
+	}
+	return filepath.Join(expandDir, c.GetMetadata().GetName()), nil
+}
@@ -0,0 +1,74 @@
+package installer
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// parseDependsOn parses each of refs as a "<group>/<version>/<kind>"
+// reference into a GVK, e.g. "cert-manager.io/v1/Certificate".
+func parseDependsOn(refs []string) ([]schema.GroupVersionKind, error) {
+	gvks := make([]schema.GroupVersionKind, 0, len(refs))
+	for _, ref := range refs {
+		parts := strings.SplitN(ref, "/", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid dependsOn reference %q: want <group>/<version>/<kind>", ref)
+		}
+		gvks = append(gvks, schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]})
+	}
+	return gvks, nil
+}
+
+// resolveDependencyOrder topologically sorts the GVKs in m by their
+// WatchedGVK.DependsOn edges, assigning each entry's Order to its position
+// in that order (0 for the first GVK; a GVK always comes after every GVK it
+// depends on). It returns an error if the dependsOn configuration in
+// watches.yaml names a GVK that isn't watched or forms a cycle.
+func resolveDependencyOrder(m map[schema.GroupVersionKind]WatchedGVK) error {
+	inDegree := make(map[schema.GroupVersionKind]int, len(m))
+	dependents := map[schema.GroupVersionKind][]schema.GroupVersionKind{}
+	for gvk, wg := range m {
+		if _, ok := inDegree[gvk]; !ok {
+			inDegree[gvk] = 0
+		}
+		for _, dep := range wg.DependsOn {
+			if _, ok := m[dep]; !ok {
+				return fmt.Errorf("%v dependsOn %v, which is not a watched GVK", gvk, dep)
+			}
+			inDegree[gvk]++
+			dependents[dep] = append(dependents[dep], gvk)
+		}
+	}
+
+	var queue []schema.GroupVersionKind
+	for gvk, degree := range inDegree {
+		if degree == 0 {
+			queue = append(queue, gvk)
+		}
+	}
+
+	order, resolved := 0, 0
+	for len(queue) > 0 {
+		gvk := queue[0]
+		queue = queue[1:]
+		wg := m[gvk]
+		wg.Order = order
+		m[gvk] = wg
+		order++
+		resolved++
+
+		for _, dependent := range dependents[gvk] {
+			inDegree[dependent]--
+			if inDegree[dependent] == 0 {
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	if resolved != len(inDegree) {
+		return fmt.Errorf("dependsOn configuration contains a cycle")
+	}
+	return nil
+}
@@ -7,22 +7,33 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/api"
 
 	yaml "gopkg.in/yaml.v2"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/engine"
 	"k8s.io/helm/pkg/kube"
 	cpb "k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/proto/hapi/release"
 	"k8s.io/helm/pkg/proto/hapi/services"
+	"k8s.io/helm/pkg/releaseutil"
 	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/storage/driver"
 	storageerrors "k8s.io/helm/pkg/storage/errors"
 	"k8s.io/helm/pkg/tiller"
 	"k8s.io/helm/pkg/tiller/environment"
@@ -33,8 +44,33 @@ import (
 // Installer can install and uninstall Helm releases given a custom resource
 // which provides runtime values for the Chart.
 type Installer interface {
-	InstallRelease(u *unstructured.Unstructured) (*unstructured.Unstructured, error)
-	UninstallRelease(u *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	// InstallRelease installs or updates the release for u. ctx bounds how
+	// long the underlying Tiller call is allowed to run; ctx is cancelled
+	// (InstallRelease then triggers the same rollback/uninstall cleanup it
+	// uses for any other Tiller error) before that.
+	InstallRelease(ctx context.Context, u *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	// UninstallRelease uninstalls the release for u. ctx bounds how long the
+	// underlying Tiller call is allowed to run.
+	UninstallRelease(ctx context.Context, u *unstructured.Unstructured) (*unstructured.Unstructured, error)
+
+	// DependentResourceGVKs returns the distinct GroupVersionKinds rendered
+	// into the most recently deployed release for u, so a controller can
+	// watch them for drift instead of relying solely on periodic polling.
+	DependentResourceGVKs(u *unstructured.Unstructured) ([]schema.GroupVersionKind, error)
+
+	// UninstallWaitEnabled reports whether u's uninstall should wait for its
+	// chart-rendered resources to be removed from the cluster before the
+	// caller strips its finalizer, so dependent resources can't outlive the
+	// CR that owns them.
+	UninstallWaitEnabled(u *unstructured.Unstructured) bool
+	// DeployedManifest returns the manifest of u's most recently deployed
+	// release, or "" if none is deployed. It must be called before
+	// UninstallRelease, which purges that release from the storage backend.
+	DeployedManifest(u *unstructured.Unstructured) (string, error)
+	// AwaitingDependentResourceRemoval reports whether any resource rendered
+	// into manifest is still present in u's namespace, so a caller honoring
+	// UninstallWaitEnabled knows whether it's safe to remove its finalizer.
+	AwaitingDependentResourceRemoval(ctx context.Context, u *unstructured.Unstructured, manifest string) (bool, error)
 }
 
 // assert interface
@@ -48,6 +84,22 @@ const (
 
 	defaultOperatorName         = "helm-app-operator"
 	defaultHelmChartWatchesFile = "/opt/helm/watches.yaml"
+
+	// DefaultTimeoutAnnotation sets, in seconds, how long InstallRelease and
+	// UninstallRelease wait for Tiller to finish before their context is
+	// cancelled, overriding the watch's own ReconcileOptions.Timeout.
+	DefaultTimeoutAnnotation = "helm.sdk.operatorframework.io/timeout"
+
+	// DefaultAtomicAnnotation, set to "true", enables atomic mode for a CR,
+	// overriding the watch's own ReconcileOptions.Atomic. See the Atomic
+	// field on installer for what atomic mode does.
+	DefaultAtomicAnnotation = "helm.sdk.operatorframework.io/atomic"
+
+	// DefaultUninstallWaitAnnotation, when set to "true" on the watched CR,
+	// makes UninstallWaitEnabled report true for it, so the reconciler waits
+	// for its release's dependent resources to be removed from the cluster
+	// before removing its finalizer.
+	DefaultUninstallWaitAnnotation = "helm.sdk.operatorframework.io/uninstall-wait"
 )
 
 var (
@@ -62,13 +114,67 @@ func init() {
 // reconcile CR updates for GVKs registered as helm apps.
 type installer struct {
 	tillerKubeClient *kube.Client
-	storageBackend   *storage.Storage
-	chartDir         string
+	chartDir         *chartSource
+
+	// maxHistory caps how many of the most recent revisions are retained in
+	// the storage backend after a successful upgrade; a DEPLOYED revision is
+	// never pruned. Zero means unlimited.
+	maxHistory int
+
+	// timeout bounds how long InstallRelease and UninstallRelease wait for
+	// Tiller, unless overridden per-CR by DefaultTimeoutAnnotation. Zero
+	// means no timeout beyond whatever the caller's ctx already carries.
+	timeout time.Duration
+
+	// atomic, unless overridden per-CR by DefaultAtomicAnnotation, enables
+	// atomic mode: Tiller waits for every rendered resource to become Ready
+	// before an install or upgrade is considered Deployed, and a failed
+	// install is purged rather than left behind half-applied, mirroring
+	// upstream Helm's `--atomic` flag. A failed upgrade is rolled back to the
+	// last deployed revision whether or not atomic mode is on.
+	atomic bool
+}
+
+// atomicFor reports whether InstallRelease should run in atomic mode for u:
+// the DefaultAtomicAnnotation value if present and valid, otherwise
+// i.atomic.
+func (i installer) atomicFor(u *unstructured.Unstructured) bool {
+	if v, ok := u.GetAnnotations()[DefaultAtomicAnnotation]; ok {
+		if atomic, err := strconv.ParseBool(v); err == nil {
+			return atomic
+		}
+	}
+	return i.atomic
+}
+
+// timeoutFor returns the timeout InstallRelease/UninstallRelease should use
+// for u: the DefaultTimeoutAnnotation value if present and valid, otherwise
+// i.timeout.
+func (i installer) timeoutFor(u *unstructured.Unstructured) time.Duration {
+	if v, ok := u.GetAnnotations()[DefaultTimeoutAnnotation]; ok {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return i.timeout
+}
+
+// withTimeout derives a context bounded by i.timeoutFor(u) from ctx, if any
+// timeout applies. The returned CancelFunc must always be called by the
+// caller to release resources, even when no timeout was applied.
+func (i installer) withTimeout(ctx context.Context, u *unstructured.Unstructured) (context.Context, context.CancelFunc) {
+	if timeout := i.timeoutFor(u); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 // InstallRelease accepts an unstructured object, installs a Helm release using Tiller,
 // and returns the object with updated `status`.
-func (i installer) InstallRelease(u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+func (i installer) InstallRelease(ctx context.Context, u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	ctx, cancel := i.withTimeout(ctx, u)
+	defer cancel()
+
 	rel := releaseName(u)
 	cr, err := valuesFromResource(u)
 	if err != nil {
@@ -76,9 +182,12 @@ func (i installer) InstallRelease(u *unstructured.Unstructured) (*unstructured.U
 	}
 	config := &cpb.Config{Raw: string(cr)}
 
-	chart, err := chartutil.LoadDir(i.chartDir)
+	status := api.StatusFor(u)
+
+	chartDir := i.chartDir.ChartDir()
+	chart, err := chartutil.LoadDir(chartDir)
 	if err != nil {
-		return u, fmt.Errorf("failed loading chart %s for release %s: %s", i.chartDir, rel, err)
+		return u, fmt.Errorf("failed loading chart %s for release %s: %s", chartDir, rel, err)
 	}
 
 	err = processRequirements(chart, config)
@@ -86,30 +195,64 @@ func (i installer) InstallRelease(u *unstructured.Unstructured) (*unstructured.U
 		return u, fmt.Errorf("failed processing requirements for release %s: %s", rel, err)
 	}
 
-	err = i.syncReleaseStatus(u)
+	storageBackend, err := i.storageBackendForNamespace(u.GetNamespace())
+	if err != nil {
+		return u, fmt.Errorf("failed building storage backend for release %s: %s", rel, err)
+	}
+
+	err = i.syncReleaseStatus(storageBackend, u)
 	if err != nil {
 		return u, fmt.Errorf("failed syncing status for release %s: %s", rel, err)
 	}
+	status.SetCondition(api.Condition{Type: api.ConditionInitialized, Status: api.ConditionStatusTrue})
 
-	tiller := i.tillerRendererForCR(u)
+	tiller := i.tillerRendererForCR(u, storageBackend)
+	atomic := i.atomicFor(u)
+
+	if status.PendingRollbackRevision != 0 {
+		log.Printf("resuming rollback of %s to revision %d left pending by a prior failed reconcile", rel, status.PendingRollbackRevision)
+		if rollbackErr := i.rollbackRelease(ctx, tiller, rel, status.PendingRollbackRevision, true); rollbackErr != nil {
+			log.Printf("failed resuming rollback of %s to revision %d: %s", rel, status.PendingRollbackRevision, rollbackErr)
+		} else {
+			status.SetPendingRollbackRevision(0)
+		}
+	}
+
+	// skipDryRun is true once we've already reconciled this exact generation
+	// of the CR: spec (and therefore the rendered chart) can't have changed
+	// without bumping metadata.generation, so there's no need to pay for
+	// another dry-run update just to confirm that.
+	skipDryRun := status.ObservedGeneration != 0 && status.ObservedGeneration == u.GetGeneration()
 
 	var updatedRelease *release.Release
-	deployedRelease, err := i.storageBackend.Deployed(rel)
+	deployedRelease, err := storageBackend.Deployed(rel)
 	if err != nil || deployedRelease == nil {
-		updatedRelease, err = i.installRelease(u, tiller, chart, config)
-		if err != nil {
-			return u, fmt.Errorf("failed installing release %s: %s", rel, err)
-		}
+		updatedRelease, err = i.installRelease(ctx, u, tiller, chart, config, atomic)
 	} else {
-		updatedRelease, err = i.updateRelease(u, tiller, deployedRelease, chart, config)
-		if err != nil {
-			return u, fmt.Errorf("failed updating release %s: %s", rel, err)
+		updatedRelease, err = i.updateRelease(ctx, u, status, tiller, storageBackend, deployedRelease, chart, config, skipDryRun, atomic)
+	}
+	if err != nil {
+		reason := api.ReasonApplyFailed
+		if rollback, ok := err.(*rollbackError); ok {
+			reason = rollback.reason
+			err = rollback.err
 		}
+		status.SetCondition(api.Condition{
+			Type:    api.ConditionReleaseFailed,
+			Status:  api.ConditionStatusTrue,
+			Reason:  reason,
+			Message: err.Error(),
+		})
+		status.SetPhase(api.PhaseFailed, reason, err.Error())
+		u.Object["status"] = status
+		return u, fmt.Errorf("failed applying release %s: %s", rel, err)
 	}
+	status.RemoveCondition(api.ConditionReleaseFailed)
 
-	status := api.StatusFor(u)
 	status.SetRelease(updatedRelease)
 	status.SetPhase(api.PhaseApplied, api.ReasonApplySuccessful, "")
+	status.SetCondition(api.Condition{Type: api.ConditionDeployed, Status: api.ConditionStatusTrue, Reason: api.ReasonApplySuccessful})
+	status.SetObservedGeneration(u.GetGeneration())
 	u.Object["status"] = status
 
 	return u, nil
@@ -117,68 +260,103 @@ func (i installer) InstallRelease(u *unstructured.Unstructured) (*unstructured.U
 
 // UninstallRelease accepts an unstructured object, uninstalls a Helm release
 // using Tiller, and returns the object with updated `status`.
-func (i installer) UninstallRelease(u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+func (i installer) UninstallRelease(ctx context.Context, u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	ctx, cancel := i.withTimeout(ctx, u)
+	defer cancel()
+
 	rel := releaseName(u)
-	tiller := i.tillerRendererForCR(u)
+	status := api.StatusFor(u)
+
+	storageBackend, err := i.storageBackendForNamespace(u.GetNamespace())
+	if err != nil {
+		return u, fmt.Errorf("failed building storage backend for release %s: %s", rel, err)
+	}
+	tiller := i.tillerRendererForCR(u, storageBackend)
 
 	// If the release is not in the storage backend, it has already been uninstalled.
-	_, err := i.storageBackend.Last(rel)
+	_, err = storageBackend.Last(rel)
 	if err != nil {
 		return u, nil
 	}
 
+	status.SetCondition(api.Condition{Type: api.ConditionUninstalling, Status: api.ConditionStatusTrue})
+	u.Object["status"] = status
+
 	log.Printf("uninstalling release for %s", rel)
 
-	_, err = tiller.UninstallRelease(context.TODO(), &services.UninstallReleaseRequest{
+	_, err = tiller.UninstallRelease(ctx, &services.UninstallReleaseRequest{
 		Name:  rel,
 		Purge: true,
 	})
 	if err != nil {
+		status.SetCondition(api.Condition{
+			Type:    api.ConditionReleaseFailed,
+			Status:  api.ConditionStatusTrue,
+			Reason:  api.ReasonApplyFailed,
+			Message: err.Error(),
+		})
+		u.Object["status"] = status
 		return u, fmt.Errorf("tiller failed uninstalling release %s: %s", rel, err)
 	}
+	status.RemoveCondition(api.ConditionUninstalling)
+	status.RemoveCondition(api.ConditionDeployed)
+	u.Object["status"] = status
 	return u, nil
 }
 
-func (i installer) installRelease(u *unstructured.Unstructured, tiller *tiller.ReleaseServer, chart *cpb.Chart, config *cpb.Config) (*release.Release, error) {
+func (i installer) installRelease(ctx context.Context, u *unstructured.Unstructured, tiller *tiller.ReleaseServer, chart *cpb.Chart, config *cpb.Config, atomic bool) (*release.Release, error) {
 	rel := releaseName(u)
 	installReq := &services.InstallReleaseRequest{
 		Namespace: u.GetNamespace(),
 		Name:      rel,
 		Chart:     chart,
 		Values:    config,
+		Wait:      atomic,
+		Timeout:   int64(i.timeoutFor(u).Seconds()),
 	}
 
 	log.Printf("installing release for %s", rel)
-	releaseResponse, err := tiller.InstallRelease(context.TODO(), installReq)
+	releaseResponse, err := tiller.InstallRelease(ctx, installReq)
 	if err != nil {
+		if atomic {
+			log.Printf("purging failed atomic install of %s: %s", rel, err)
+			if _, purgeErr := tiller.UninstallRelease(ctx, &services.UninstallReleaseRequest{Name: rel, Purge: true}); purgeErr != nil {
+				return nil, fmt.Errorf("tiller failed install: %s; purge also failed: %s", err, purgeErr)
+			}
+		}
 		return nil, fmt.Errorf("tiller failed install: %s", err)
 	}
 	return releaseResponse.GetRelease(), nil
 }
 
-func (i installer) updateRelease(u *unstructured.Unstructured, tiller *tiller.ReleaseServer, deployedRelease *release.Release, chart *cpb.Chart, config *cpb.Config) (*release.Release, error) {
+func (i installer) updateRelease(ctx context.Context, u *unstructured.Unstructured, status *api.HelmAppStatus, tiller *tiller.ReleaseServer, storageBackend *storage.Storage, deployedRelease *release.Release, chart *cpb.Chart, config *cpb.Config, skipDryRun, atomic bool) (*release.Release, error) {
 	rel := releaseName(u)
 	force := isForceUpdate(u)
-	dryRunReq := &services.UpdateReleaseRequest{
-		Name:   rel,
-		Chart:  chart,
-		Values: config,
-		Force:  force,
-		DryRun: true,
-	}
+	deployedManifest := deployedRelease.GetManifest()
+	candidateManifest := deployedManifest
+
+	if !skipDryRun {
+		dryRunReq := &services.UpdateReleaseRequest{
+			Name:   rel,
+			Chart:  chart,
+			Values: config,
+			Force:  force,
+			DryRun: true,
+		}
 
-	dryRunResponse, err := tiller.UpdateRelease(context.TODO(), dryRunReq)
-	if err != nil {
-		return nil, fmt.Errorf("tiller failed dry run update: %s", err)
+		dryRunResponse, err := tiller.UpdateRelease(ctx, dryRunReq)
+		if err != nil {
+			return nil, fmt.Errorf("tiller failed dry run update: %s", err)
+		}
+		candidateManifest = dryRunResponse.GetRelease().GetManifest()
+	} else {
+		log.Printf("skipping dry run update for %s: generation unchanged since last reconcile", rel)
 	}
 
-	deployedManifest := deployedRelease.GetManifest()
-	candidateManifest := dryRunResponse.GetRelease().GetManifest()
-
 	if deployedManifest == candidateManifest {
 		// reconcile resources
 		log.Printf("reconciling resources for unchanged release %s", rel)
-		if err := i.reconcileResources(u, deployedManifest, force); err != nil {
+		if err := i.reconcileResources(u, deployedManifest, candidateManifest, force); err != nil {
 			return nil, fmt.Errorf("failed reconciling resources: %s", err)
 		}
 
@@ -189,21 +367,129 @@ func (i installer) updateRelease(u *unstructured.Unstructured, tiller *tiller.Re
 	log.Printf("updating release for %s", rel)
 
 	updateReq := &services.UpdateReleaseRequest{
-		Name:   rel,
-		Chart:  chart,
-		Values: config,
-		Force:  force,
+		Name:    rel,
+		Chart:   chart,
+		Values:  config,
+		Force:   force,
+		Wait:    atomic,
+		Timeout: int64(i.timeoutFor(u).Seconds()),
 	}
 
-	updateResponse, err := tiller.UpdateRelease(context.TODO(), updateReq)
+	updateResponse, err := tiller.UpdateRelease(ctx, updateReq)
 	if err != nil {
-		return nil, fmt.Errorf("tiller failed update: %s", err)
+		// Record the revision we're about to roll back to before attempting
+		// it, so a crash or context cancellation between the rollback call
+		// and this function returning doesn't leave the release on a FAILED
+		// revision with nothing to signal that a rollback is still owed.
+		status.SetPendingRollbackRevision(deployedRelease.GetVersion())
+		if rollbackErr := i.rollbackRelease(ctx, tiller, rel, deployedRelease.GetVersion(), force); rollbackErr != nil {
+			return nil, &rollbackError{
+				reason: api.ReasonRollbackFailed,
+				err:    fmt.Errorf("tiller failed update: %s; rollback to revision %d also failed: %s", err, deployedRelease.GetVersion(), rollbackErr),
+			}
+		}
+		status.SetPendingRollbackRevision(0)
+		return nil, &rollbackError{
+			reason: api.ReasonRollbackSucceeded,
+			err:    fmt.Errorf("tiller failed update: %s; rolled back to revision %d", err, deployedRelease.GetVersion()),
+		}
+	}
+
+	if i.maxHistory > 0 {
+		if err := pruneHistory(storageBackend, rel, i.maxHistory); err != nil {
+			log.Printf("failed pruning release history for %s: %s", rel, err)
+		}
 	}
 
 	return updateResponse.GetRelease(), nil
 }
 
-func (i installer) reconcileResources(u *unstructured.Unstructured, expectedManifest string, force bool) error {
+// rollbackCleanupTimeout bounds rollbackRelease's own Tiller call. It always
+// runs against a fresh context rather than the one passed to updateRelease,
+// since that context may be the very one whose cancellation caused the
+// update it's cleaning up after to fail; reusing it would make rollback fail
+// too and leave the release stuck on a FAILED revision.
+const rollbackCleanupTimeout = 30 * time.Second
+
+// rollbackRelease rolls rel back to toVersion, the last known-good revision,
+// after an upgrade attempt fails. Without this, a failed upgrade leaves the
+// release (and the CR's status) stuck on a FAILED revision with no recovery
+// path.
+func (i installer) rollbackRelease(ctx context.Context, tiller *tiller.ReleaseServer, rel string, toVersion int32, force bool) error {
+	log.Printf("rolling back release %s to revision %d after failed update", rel, toVersion)
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), rollbackCleanupTimeout)
+	defer cancel()
+	_, err := tiller.RollbackRelease(cleanupCtx, &services.RollbackReleaseRequest{
+		Name:    rel,
+		Version: toVersion,
+		Force:   force,
+	})
+	if err != nil {
+		return fmt.Errorf("tiller failed rollback: %s", err)
+	}
+	return nil
+}
+
+// pruneHistory removes superseded, non-deployed revisions of rel from
+// storageBackend once more than maxHistory are recorded, so long-lived
+// operators don't accumulate unbounded release history in the backing
+// Secrets.
+func pruneHistory(storageBackend *storage.Storage, rel string, maxHistory int) error {
+	history, err := storageBackend.History(rel)
+	if err != nil {
+		return fmt.Errorf("failed listing history for %s: %s", rel, err)
+	}
+	if len(history) <= maxHistory {
+		return nil
+	}
+	releaseutil.SortByRevision(history)
+
+	for _, old := range history[:len(history)-maxHistory] {
+		if old.GetInfo().GetStatus().GetCode() == release.Status_DEPLOYED {
+			continue
+		}
+		if _, err := storageBackend.Delete(old.GetName(), old.GetVersion()); err != nil {
+			return fmt.Errorf("failed deleting revision %d for %s: %s", old.GetVersion(), rel, err)
+		}
+	}
+	return nil
+}
+
+// rollbackError wraps an update failure with the Reason that should be
+// reported on the release-failed condition, distinguishing an update that
+// was successfully rolled back from one that could not be rolled back at
+// all.
+type rollbackError struct {
+	reason api.Reason
+	err    error
+}
+
+func (e *rollbackError) Error() string {
+	return e.err.Error()
+}
+
+// reconcileResources reconciles each resource in expectedManifest against
+// the live cluster state. previousManifest is the manifest of the
+// previously deployed release and is used as the "original" side of a
+// three-way merge so that fields added by other controllers (or by the
+// cluster itself) aren't clobbered.
+func (i installer) reconcileResources(u *unstructured.Unstructured, previousManifest, expectedManifest string, force bool) error {
+	previousInfos, err := i.tillerKubeClient.BuildUnstructured(u.GetNamespace(), bytes.NewBufferString(previousManifest))
+	if err != nil {
+		return fmt.Errorf("failed building unstructured objects for previous release: %s", err)
+	}
+	previous := map[string]*resource.Info{}
+	err = previousInfos.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		previous[infoKey(info)] = info
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed indexing previous release objects: %s", err)
+	}
+
 	expectedInfos, err := i.tillerKubeClient.BuildUnstructured(u.GetNamespace(), bytes.NewBufferString(expectedManifest))
 	if err != nil {
 		return fmt.Errorf("failed building unstructured objects: %s", err)
@@ -213,7 +499,7 @@ func (i installer) reconcileResources(u *unstructured.Unstructured, expectedMani
 		if err != nil {
 			return err
 		}
-		err = reconcileObject(expected, force)
+		err = reconcileObject(expected, previous[infoKey(expected)], force)
 		if err != nil {
 			return fmt.Errorf("failed reconciling object: %s", err)
 		}
@@ -221,25 +507,157 @@ func (i installer) reconcileResources(u *unstructured.Unstructured, expectedMani
 	})
 }
 
-func reconcileObject(expected *resource.Info, force bool) error {
+// DependentResourceGVKs returns the distinct GroupVersionKinds rendered into
+// the most recently deployed release for u, so a controller can watch them
+// for drift instead of relying solely on periodic polling.
+func (i installer) DependentResourceGVKs(u *unstructured.Unstructured) ([]schema.GroupVersionKind, error) {
+	rel := releaseName(u)
+	storageBackend, err := i.storageBackendForNamespace(u.GetNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("failed building storage backend for release %s: %s", rel, err)
+	}
+	deployedRelease, err := storageBackend.Deployed(rel)
+	if err != nil || deployedRelease == nil {
+		return nil, nil
+	}
+
+	infos, err := i.tillerKubeClient.BuildUnstructured(u.GetNamespace(), bytes.NewBufferString(deployedRelease.GetManifest()))
+	if err != nil {
+		return nil, fmt.Errorf("failed building unstructured objects for release %s: %s", rel, err)
+	}
+
+	seen := map[schema.GroupVersionKind]bool{}
+	var gvks []schema.GroupVersionKind
+	err = infos.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		gvk := info.Mapping.GroupVersionKind
+		if !seen[gvk] {
+			seen[gvk] = true
+			gvks = append(gvks, gvk)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed indexing release objects for %s: %s", rel, err)
+	}
+	return gvks, nil
+}
+
+// UninstallWaitEnabled reports whether u carries DefaultUninstallWaitAnnotation
+// set to "true".
+func (i installer) UninstallWaitEnabled(u *unstructured.Unstructured) bool {
+	v, ok := u.GetAnnotations()[DefaultUninstallWaitAnnotation]
+	if !ok {
+		return false
+	}
+	enabled, err := strconv.ParseBool(v)
+	return err == nil && enabled
+}
+
+// DeployedManifest returns the manifest of u's most recently deployed
+// release, or "" if none is deployed.
+func (i installer) DeployedManifest(u *unstructured.Unstructured) (string, error) {
+	rel := releaseName(u)
+	storageBackend, err := i.storageBackendForNamespace(u.GetNamespace())
+	if err != nil {
+		return "", fmt.Errorf("failed building storage backend for release %s: %s", rel, err)
+	}
+	deployedRelease, err := storageBackend.Deployed(rel)
+	if err != nil || deployedRelease == nil {
+		return "", nil
+	}
+	return deployedRelease.GetManifest(), nil
+}
+
+// AwaitingDependentResourceRemoval reports whether any resource rendered
+// into manifest is still present in u's namespace, so a caller honoring
+// UninstallWaitEnabled knows whether it's safe to remove its finalizer.
+func (i installer) AwaitingDependentResourceRemoval(ctx context.Context, u *unstructured.Unstructured, manifest string) (bool, error) {
+	if manifest == "" {
+		return false, nil
+	}
+	infos, err := i.tillerKubeClient.BuildUnstructured(u.GetNamespace(), bytes.NewBufferString(manifest))
+	if err != nil {
+		return false, fmt.Errorf("failed building unstructured objects for uninstalled release: %s", err)
+	}
+
+	remaining := false
+	err = infos.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		helper := resource.NewHelper(info.Client, info.Mapping)
+		if _, getErr := helper.Get(info.Namespace, info.Name, false); getErr == nil {
+			remaining = true
+		} else if !apierrors.IsNotFound(getErr) {
+			return getErr
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed checking for remaining dependent resources: %s", err)
+	}
+	return remaining, nil
+}
+
+// infoKey uniquely identifies a resource.Info by GVK, namespace, and name so
+// that resources from two different manifests can be paired up.
+func infoKey(info *resource.Info) string {
+	gvk := info.Mapping.GroupVersionKind
+	return fmt.Sprintf("%s/%s/%s/%s", gvk.GroupVersion(), gvk.Kind, info.Namespace, info.Name)
+}
+
+// unsafeStrategicMergeKinds lists kinds for which a three-way merge patch is
+// unsafe and reconcileObject instead does a get-then-replace. A Service's
+// .spec.clusterIP is immutable and allocated by the API server; a strategic
+// merge computed against an empty "original" (e.g. the resource predates
+// last-applied tracking) can null it out and break the patch.
+var unsafeStrategicMergeKinds = map[schema.GroupVersionKind]bool{
+	{Version: "v1", Kind: "Service"}: true,
+}
+
+// reconcileObject brings the live object in line with expected. If original
+// is nil, the resource was created since the last release and is simply
+// created. Otherwise, a three-way merge patch is computed between original,
+// expected, and the live object so that fields managed by other controllers
+// (HPA-managed replicas, a Service's clusterIP, etc.) are preserved, unless
+// the kind is listed in unsafeStrategicMergeKinds, in which case replaceObject
+// is used instead.
+func reconcileObject(expected, original *resource.Info, force bool) error {
 	helper := resource.NewHelper(expected.Client, expected.Mapping)
 
-	// Attempt to create object
-	_, err := helper.Create(expected.Namespace, true, expected.Object)
-	if err == nil || !apierrors.IsAlreadyExists(err) {
-		return err
+	if original == nil {
+		_, err := helper.Create(expected.Namespace, true, expected.Object)
+		if err == nil || !apierrors.IsAlreadyExists(err) {
+			return err
+		}
 	}
 
-	// If object already exists, patch it instead. We can't do a diff patch
-	// because Kubernetes sometimes automatically adds immutable fields
-	// (e.g. `clusterIp` to a Service). This can cause reconciliation
-	// failures even when the objects are otherwise completely unchanged.
-	patch, err := json.Marshal(expected.Object)
+	live, err := helper.Get(expected.Namespace, expected.Name, false)
 	if err != nil {
-		return fmt.Errorf("failed to marshal patch for object: %s", err)
+		if apierrors.IsNotFound(err) {
+			_, err := helper.Create(expected.Namespace, true, expected.Object)
+			return err
+		}
+		return fmt.Errorf("failed to get live object: %s", err)
 	}
 
-	_, err = helper.Patch(expected.Namespace, expected.Name, types.MergePatchType, patch)
+	if unsafeStrategicMergeKinds[expected.Mapping.GroupVersionKind] {
+		return replaceObject(helper, expected, live)
+	}
+
+	patch, patchType, err := threeWayMergePatch(expected.Mapping.GroupVersionKind, original, expected, live)
+	if err != nil {
+		return fmt.Errorf("failed computing patch: %s", err)
+	}
+	if patch == nil {
+		// Nothing to apply; skip the API call entirely.
+		return nil
+	}
+
+	_, err = helper.Patch(expected.Namespace, expected.Name, patchType, patch)
 	if err != nil {
 		if !force {
 			return fmt.Errorf("failed patching object: %s", err)
@@ -258,6 +676,84 @@ func reconcileObject(expected *resource.Info, force bool) error {
 	return nil
 }
 
+// replaceObject overwrites live with expected via Update instead of a patch.
+// It carries over live's resourceVersion, required by the API server, and
+// for Services, live's API-server-assigned .spec.clusterIP, so a chart that
+// never sets one itself doesn't clobber it.
+func replaceObject(helper *resource.Helper, expected *resource.Info, live runtime.Object) error {
+	liveAccessor, err := meta.Accessor(live)
+	if err != nil {
+		return fmt.Errorf("failed to access live object metadata: %s", err)
+	}
+
+	expectedUnstructured, ok := expected.Object.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("expected object for %s is not unstructured", infoKey(expected))
+	}
+	expectedUnstructured.SetResourceVersion(liveAccessor.GetResourceVersion())
+
+	if liveUnstructured, ok := live.(*unstructured.Unstructured); ok {
+		if clusterIP, found, _ := unstructured.NestedString(liveUnstructured.Object, "spec", "clusterIP"); found && clusterIP != "" {
+			if _, exists, _ := unstructured.NestedString(expectedUnstructured.Object, "spec", "clusterIP"); !exists {
+				_ = unstructured.SetNestedField(expectedUnstructured.Object, clusterIP, "spec", "clusterIP")
+			}
+		}
+	}
+
+	_, err = helper.Replace(expected.Namespace, expected.Name, true, expectedUnstructured)
+	return err
+}
+
+// threeWayMergePatch computes a patch that applies the changes made between
+// original and expected onto live, using a strategic merge patch for
+// built-in kinds that are registered in the client-go scheme, and falling
+// back to a JSON merge patch for CRDs and other unregistered kinds. A nil
+// patch means the computed diff is empty and the caller can skip the API
+// call.
+func threeWayMergePatch(gvk schema.GroupVersionKind, original, expected *resource.Info, live runtime.Object) ([]byte, types.PatchType, error) {
+	var originalJSON []byte
+	if original != nil {
+		b, err := json.Marshal(original.Object)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal original object: %s", err)
+		}
+		originalJSON = b
+	} else {
+		originalJSON = []byte("{}")
+	}
+
+	expectedJSON, err := json.Marshal(expected.Object)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal expected object: %s", err)
+	}
+
+	liveJSON, err := json.Marshal(live)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal live object: %s", err)
+	}
+
+	var patch []byte
+	var patchType types.PatchType
+	if versioned, err := scheme.Scheme.New(gvk); err == nil {
+		patch, err = strategicpatch.CreateThreeWayMergePatch(originalJSON, expectedJSON, liveJSON, versioned, true)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create strategic merge patch: %s", err)
+		}
+		patchType = types.StrategicMergePatchType
+	} else {
+		patch, err = jsonmergepatch.CreateThreeWayJSONMergePatch(originalJSON, expectedJSON, liveJSON)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create JSON merge patch: %s", err)
+		}
+		patchType = types.MergePatchType
+	}
+
+	if string(patch) == "{}" {
+		return nil, "", nil
+	}
+	return patch, patchType, nil
+}
+
 func valuesFromResource(u *unstructured.Unstructured) ([]byte, error) {
 	return yaml.Marshal(u.Object["spec"])
 }
@@ -272,26 +768,48 @@ func isForceUpdate(u *unstructured.Unstructured) bool {
 }
 
 // syncReleaseStatus ensures the object's release is present in the storage
-// backend
-func (i installer) syncReleaseStatus(u *unstructured.Unstructured) error {
+// backend. This also serves as the migration path for releases that were
+// previously tracked only in `status.release` by a legacy in-memory storage
+// backend: seeding them into the namespace's Secrets backend here means a
+// CR reconciled against a fresh operator pod doesn't lose its release history.
+func (i installer) syncReleaseStatus(storageBackend *storage.Storage, u *unstructured.Unstructured) error {
 	status := api.StatusFor(u)
 	if status.Release == nil {
 		return nil
 	}
-	_, err := i.storageBackend.Get(status.Release.GetName(), status.Release.GetVersion())
+	_, err := storageBackend.Get(status.Release.GetName(), status.Release.GetVersion())
 	if err != nil {
 		key := fmt.Sprintf("%s.v%d", status.Release.GetName(), status.Release.GetVersion())
 		if err.Error() == storageerrors.ErrReleaseNotFound(key).Error() {
-			return i.storageBackend.Create(status.Release)
+			return storageBackend.Create(status.Release)
 		}
 		return err
 	}
 	return nil
 }
 
+// storageBackendForNamespace returns a Helm storage backend backed by
+// Kubernetes Secrets in the given namespace. Scoping storage to the CR's
+// namespace means release history survives operator restarts and stays
+// isolated between namespaces, matching the storage model used by
+// helm-operator upstream.
+func (i installer) storageBackendForNamespace(namespace string) (*storage.Storage, error) {
+	cfg, err := i.tillerKubeClient.ToRESTConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rest config: %s", err)
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %s", err)
+	}
+	d := driver.NewSecrets(clientset.CoreV1().Secrets(namespace))
+	d.Log = log.Printf
+	return storage.Init(d), nil
+}
+
 // tillerRendererForCR creates a ReleaseServer configured with a rendering
 // engine that adds ownerrefs to rendered assets based on the CR.
-func (i installer) tillerRendererForCR(u *unstructured.Unstructured) *tiller.ReleaseServer {
+func (i installer) tillerRendererForCR(u *unstructured.Unstructured, storageBackend *storage.Storage) *tiller.ReleaseServer {
 	controllerRef := metav1.NewControllerRef(u, u.GroupVersionKind())
 	ownerRefs := []metav1.OwnerReference{
 		*controllerRef,
@@ -303,7 +821,7 @@ func (i installer) tillerRendererForCR(u *unstructured.Unstructured) *tiller.Rel
 	}
 	env := &environment.Environment{
 		EngineYard: ey,
-		Releases:   i.storageBackend,
+		Releases:   storageBackend,
 		KubeClient: i.tillerKubeClient,
 	}
 	cfg, _ := i.tillerKubeClient.ToRESTConfig()
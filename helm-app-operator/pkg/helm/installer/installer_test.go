@@ -0,0 +1,110 @@
+package installer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/storage/driver"
+	"k8s.io/kubernetes/pkg/kubectl/genericclioptions/resource"
+)
+
+func newTestCR(annotations map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetName("my-app")
+	u.SetNamespace("test-namespace")
+	u.SetAnnotations(annotations)
+	return u
+}
+
+func TestAtomicFor(t *testing.T) {
+	i := installer{atomic: false}
+	require.False(t, i.atomicFor(newTestCR(nil)), "absent annotation should fall back to the installer default")
+
+	i = installer{atomic: true}
+	require.True(t, i.atomicFor(newTestCR(nil)), "absent annotation should fall back to the installer default")
+	require.False(t, i.atomicFor(newTestCR(map[string]string{DefaultAtomicAnnotation: "false"})), "annotation should override the installer default")
+	require.True(t, i.atomicFor(newTestCR(map[string]string{DefaultAtomicAnnotation: "not-a-bool"})), "an invalid annotation value should fall back to the installer default")
+}
+
+func TestTimeoutFor(t *testing.T) {
+	i := installer{timeout: 30 * time.Second}
+	require.Equal(t, 30*time.Second, i.timeoutFor(newTestCR(nil)), "absent annotation should fall back to the installer default")
+	require.Equal(t, 45*time.Second, i.timeoutFor(newTestCR(map[string]string{DefaultTimeoutAnnotation: "45"})), "annotation should override the installer default")
+	require.Equal(t, 30*time.Second, i.timeoutFor(newTestCR(map[string]string{DefaultTimeoutAnnotation: "not-a-number"})), "an invalid annotation value should fall back to the installer default")
+	require.Equal(t, 30*time.Second, i.timeoutFor(newTestCR(map[string]string{DefaultTimeoutAnnotation: "-5"})), "a non-positive annotation value should fall back to the installer default")
+}
+
+func TestReleaseName(t *testing.T) {
+	operatorName = "my-operator"
+	require.Equal(t, "my-operator-my-app", releaseName(newTestCR(nil)))
+}
+
+func TestValuesFromResource(t *testing.T) {
+	u := newTestCR(nil)
+	u.Object["spec"] = map[string]interface{}{"replicaCount": int64(3)}
+	b, err := valuesFromResource(u)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "replicaCount: 3")
+}
+
+func TestIsForceUpdate(t *testing.T) {
+	require.False(t, isForceUpdate(newTestCR(nil)), "force update is not yet supported")
+}
+
+func TestPruneHistoryKeepsDeployedAndRecentRevisions(t *testing.T) {
+	storageBackend := storage.Init(driver.NewMemory())
+	for v := int32(1); v <= 3; v++ {
+		status := release.Status_SUPERSEDED
+		if v == 3 {
+			status = release.Status_DEPLOYED
+		}
+		rel := &release.Release{
+			Name:    "my-release",
+			Version: v,
+			Info:    &release.Info{Status: &release.Status{Code: status}},
+		}
+		require.NoError(t, storageBackend.Create(rel))
+	}
+
+	require.NoError(t, pruneHistory(storageBackend, "my-release", 1))
+
+	history, err := storageBackend.History("my-release")
+	require.NoError(t, err)
+	require.Len(t, history, 1, "only the deployed revision should survive pruning")
+	require.Equal(t, release.Status_DEPLOYED, history[0].GetInfo().GetStatus().GetCode())
+}
+
+// TestThreeWayMergePatchUnregisteredKind exercises the JSON-merge fallback
+// threeWayMergePatch takes for a GVK with no registered scheme (e.g. a CRD),
+// mirroring how reconcileObject is actually exercised against chart-rendered
+// custom resources.
+func TestThreeWayMergePatchUnregisteredKind(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+
+	original := &resource.Info{Object: &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}}}}
+	expected := &resource.Info{Object: &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(2)}}}}
+	live := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1), "clusterIP": "10.0.0.1"}}}
+
+	patch, patchType, err := threeWayMergePatch(gvk, original, expected, live)
+	require.NoError(t, err)
+	require.Equal(t, apitypes.MergePatchType, patchType)
+	require.Contains(t, string(patch), `"replicas":2`)
+}
+
+func TestThreeWayMergePatchNoDiffReturnsNilPatch(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+
+	same := map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}}
+	info := &resource.Info{Object: &unstructured.Unstructured{Object: same}}
+	live := &unstructured.Unstructured{Object: same}
+
+	patch, _, err := threeWayMergePatch(gvk, info, info, live)
+	require.NoError(t, err)
+	require.Nil(t, patch, "an empty diff should skip the API call entirely")
+}
@@ -4,12 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/helm/pkg/kube"
-	"k8s.io/helm/pkg/storage"
 )
 
 const (
@@ -32,8 +32,18 @@ const (
 
 	// HelmChartEnvVar is the environment variable for the directory location
 	// of the helm chart to be installed for CRs that match the values for the
-	// API_VERSION and KIND environment variables.
+	// API_VERSION and KIND environment variables. If HelmChartRepoEnvVar is
+	// also set, this instead names the chart to look up in that repository.
 	HelmChartEnvVar = "HELM_CHART"
+
+	// HelmChartRepoEnvVar, HelmChartVersionEnvVar, and
+	// HelmChartPullSecretEnvVar are the env-var equivalents of a watch's
+	// Repo, ChartVersion, and ChartPullSecret fields, for operators
+	// configured via API_VERSION/KIND/HELM_CHART instead of a watches file.
+	HelmChartRepoEnvVar            = "HELM_CHART_REPO"
+	HelmChartVersionEnvVar         = "HELM_CHART_VERSION"
+	HelmChartPullSecretEnvVar      = "HELM_CHART_PULL_SECRET"
+	HelmChartRefreshIntervalEnvVar = "HELM_CHART_REFRESH_INTERVAL"
 )
 
 // watch holds data used to create a mapping of GVK to helm chart.
@@ -43,14 +53,127 @@ type watch struct {
 	Group   string `yaml:"group"`
 	Kind    string `yaml:"kind"`
 	Chart   string `yaml:"chart"`
+
+	// Repo, ChartVersion, and ChartPullSecret allow Chart to name a
+	// remote chart instead of a local directory baked into the image. If
+	// Repo is set, Chart is looked up by name+ChartVersion in that Helm
+	// chart repository. Otherwise, Chart may be an "oci://" reference or
+	// a "git+https://" reference; anything else is treated as a local
+	// directory path, preserving the original behavior.
+	Repo            string `yaml:"repo,omitempty"`
+	ChartVersion    string `yaml:"chartVersion,omitempty"`
+	ChartPullSecret string `yaml:"chartPullSecret,omitempty"`
+
+	// ReconcilePeriod, MaxConcurrentReconciles, WatchDependentResources,
+	// and OverrideValues tune how this GVK's controller reconciles. They
+	// are surfaced to callers via WatchedGVK.Options so that main can
+	// plumb them into controller.WatchOptions per-GVK instead of using
+	// one hardcoded reconcile loop for every watch.
+	ReconcilePeriod         string            `yaml:"reconcilePeriod,omitempty"`
+	MaxConcurrentReconciles int               `yaml:"maxConcurrentReconciles,omitempty"`
+	WatchDependentResources bool              `yaml:"watchDependentResources,omitempty"`
+	OverrideValues          map[string]string `yaml:"overrideValues,omitempty"`
+
+	// Timeout bounds how long InstallRelease and UninstallRelease wait for
+	// Tiller for CRs matching this watch, unless overridden per-CR by
+	// installer.DefaultTimeoutAnnotation.
+	Timeout string `yaml:"timeout,omitempty"`
+
+	// Atomic enables atomic install/upgrade mode for CRs matching this
+	// watch, unless overridden per-CR by installer.DefaultAtomicAnnotation.
+	Atomic bool `yaml:"atomic,omitempty"`
+
+	// ChartRefreshInterval, if set, re-resolves Repo/Chart/ChartVersion (or
+	// the git/OCI reference named by Chart) on this interval so an operator
+	// watching a moving reference (a git branch, an unpinned repo lookup)
+	// picks up newly published revisions without a restart. resolveChartDir
+	// serves an existing cache entry for the same reference without
+	// fetching, so a refresh only picks up a new revision once that cache
+	// entry has been removed; it does not pull or re-download on its own.
+	ChartRefreshInterval string `yaml:"chartRefreshInterval,omitempty"`
+
+	// MaxHistory caps how many of the most recent revisions are retained in
+	// the storage backend after a successful upgrade; a DEPLOYED revision is
+	// never pruned. Zero means unlimited.
+	MaxHistory int `yaml:"maxHistory,omitempty"`
+
+	// DependsOn lists other watched GVKs, as "<group>/<version>/<kind>"
+	// references, that must already have a Deployed release in a CR's
+	// namespace before that CR's release is installed or updated. This lets
+	// a chart that assumes a CRD or operator from another watch (cert-manager,
+	// a database operator) is already running converge reliably instead of
+	// racing it on first apply.
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+}
+
+// ReconcileOptions holds per-GVK reconciliation tuning read from a
+// watches.yaml entry.
+type ReconcileOptions struct {
+	ReconcilePeriod         time.Duration
+	MaxConcurrentReconciles int
+	WatchDependentResources bool
+	OverrideValues          map[string]string
+
+	// Timeout bounds how long InstallRelease and UninstallRelease wait for
+	// Tiller, unless overridden per-CR by installer.DefaultTimeoutAnnotation.
+	Timeout time.Duration
+
+	// Atomic enables atomic install/upgrade mode, unless overridden per-CR
+	// by installer.DefaultAtomicAnnotation.
+	Atomic bool
+}
+
+// WatchedGVK pairs an Installer with the ReconcileOptions for its GVK.
+type WatchedGVK struct {
+	Installer Installer
+	Options   ReconcileOptions
+
+	// DependsOn lists the GVKs this GVK's releases must wait on; see the
+	// watch.DependsOn doc comment.
+	DependsOn []schema.GroupVersionKind
+	// Order is this GVK's position in the dependency-resolved startup
+	// order computed by resolveDependencyOrder (0 for the first GVK; a GVK
+	// always comes after every GVK it depends on), surfaced on each CR's
+	// status.
+	Order int
+}
+
+func reconcileOptionsFor(w watch) (ReconcileOptions, error) {
+	opts := ReconcileOptions{
+		MaxConcurrentReconciles: w.MaxConcurrentReconciles,
+		WatchDependentResources: w.WatchDependentResources,
+		Atomic:                  w.Atomic,
+	}
+	if w.ReconcilePeriod != "" {
+		period, err := time.ParseDuration(w.ReconcilePeriod)
+		if err != nil {
+			return opts, fmt.Errorf("invalid reconcilePeriod %q: %v", w.ReconcilePeriod, err)
+		}
+		opts.ReconcilePeriod = period
+	}
+	if len(w.OverrideValues) > 0 {
+		expanded := make(map[string]string, len(w.OverrideValues))
+		for k, v := range w.OverrideValues {
+			expanded[k] = os.ExpandEnv(v)
+		}
+		opts.OverrideValues = expanded
+	}
+	if w.Timeout != "" {
+		timeout, err := time.ParseDuration(w.Timeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid timeout %q: %v", w.Timeout, err)
+		}
+		opts.Timeout = timeout
+	}
+	return opts, nil
 }
 
-// NewFromEnv returns a map of installers based on configuration provided in
+// NewFromEnv returns a map of WatchedGVKs based on configuration provided in
 // the environment.
-func NewFromEnv(tillerKubeClient *kube.Client, storageBackend *storage.Storage) (map[schema.GroupVersionKind]Installer, error) {
+func NewFromEnv(tillerKubeClient *kube.Client) (map[schema.GroupVersionKind]WatchedGVK, error) {
 	// If there is a watches file available, get Installers from it
 	if watchesFile, ok := getWatchesFile(); ok {
-		return NewFromWatches(tillerKubeClient, storageBackend, watchesFile)
+		return NewFromWatches(tillerKubeClient, watchesFile)
 	}
 
 	// Otherwise, we'll fall back to the GVK environment variables
@@ -65,21 +188,49 @@ func NewFromEnv(tillerKubeClient *kube.Client, storageBackend *storage.Storage)
 		Kind:    kind,
 	}
 
-	chartDir := os.Getenv(HelmChartEnvVar)
-	if chartDir == "" {
+	chart := os.Getenv(HelmChartEnvVar)
+	if chart == "" {
 		return nil, fmt.Errorf("chart must be defined for %v", s)
 	}
 
-	m := map[schema.GroupVersionKind]Installer{
-		s: New(tillerKubeClient, storageBackend, chartDir),
+	refreshInterval, err := parseRefreshInterval(os.Getenv(HelmChartRefreshIntervalEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	cs, err := newChartSource(watch{
+		Chart:           chart,
+		Repo:            os.Getenv(HelmChartRepoEnvVar),
+		ChartVersion:    os.Getenv(HelmChartVersionEnvVar),
+		ChartPullSecret: os.Getenv(HelmChartPullSecretEnvVar),
+	}, refreshInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve chart for %v: %v", s, err)
+	}
+
+	m := map[schema.GroupVersionKind]WatchedGVK{
+		s: {Installer: newInstaller(tillerKubeClient, cs, 0, 0, false)},
 	}
 
 	return m, nil
 }
 
+// parseRefreshInterval parses s as a time.Duration, returning zero if s is
+// empty.
+func parseRefreshInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chart refresh interval %q: %v", s, err)
+	}
+	return interval, nil
+}
+
 // NewFromWatches reads the config file at the provided path and returns a map
-// of installers for each GVK in the config.
-func NewFromWatches(tillerKubeClient *kube.Client, storageBackend *storage.Storage, path string) (map[schema.GroupVersionKind]Installer, error) {
+// of WatchedGVKs, pairing an Installer with its per-GVK ReconcileOptions, for
+// each GVK in the config.
+func NewFromWatches(tillerKubeClient *kube.Client, path string) (map[schema.GroupVersionKind]WatchedGVK, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
@@ -90,7 +241,7 @@ func NewFromWatches(tillerKubeClient *kube.Client, storageBackend *storage.Stora
 		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
 	}
 
-	m := map[schema.GroupVersionKind]Installer{}
+	m := map[schema.GroupVersionKind]WatchedGVK{}
 	for _, w := range watches {
 		s := schema.GroupVersionKind{
 			Group:   w.Group,
@@ -104,17 +255,55 @@ func NewFromWatches(tillerKubeClient *kube.Client, storageBackend *storage.Stora
 		if w.Chart == "" {
 			return nil, fmt.Errorf("chart must be defined for %v", s)
 		}
-		m[s] = New(tillerKubeClient, storageBackend, w.Chart)
+		refreshInterval, err := parseRefreshInterval(w.ChartRefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse chart refresh interval for %v: %v", s, err)
+		}
+		cs, err := newChartSource(w, refreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve chart for %v: %v", s, err)
+		}
+		opts, err := reconcileOptionsFor(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reconcile options for %v: %v", s, err)
+		}
+		dependsOn, err := parseDependsOn(w.DependsOn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dependsOn for %v: %v", s, err)
+		}
+		m[s] = WatchedGVK{
+			Installer: newInstaller(tillerKubeClient, cs, w.MaxHistory, opts.Timeout, opts.Atomic),
+			Options:   opts,
+			DependsOn: dependsOn,
+		}
 	}
 	if len(m) == 0 {
 		return nil, fmt.Errorf("no watches configured in watches file")
 	}
+	if err := resolveDependencyOrder(m); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
-// New returns a new Helm installer capable of installing and uninstalling releases.
-func New(tillerKubeClient *kube.Client, storageBackend *storage.Storage, chartDir string) Installer {
-	return installer{tillerKubeClient, storageBackend, chartDir}
+// New returns a new Helm installer capable of installing and uninstalling
+// releases from the chart at the local directory chartDir. maxHistory caps
+// how many of the most recent revisions are retained in the storage backend
+// after a successful upgrade, never pruning a DEPLOYED revision; zero means
+// unlimited. timeout bounds how long
+// InstallRelease and UninstallRelease wait for Tiller, unless overridden
+// per-CR by DefaultTimeoutAnnotation; zero means no timeout beyond whatever
+// the caller's context already carries.
+func New(tillerKubeClient *kube.Client, chartDir string, maxHistory int, timeout time.Duration) Installer {
+	cs := &chartSource{}
+	cs.dir.Store(chartDir)
+	return newInstaller(tillerKubeClient, cs, maxHistory, timeout, false)
+}
+
+// newInstaller returns a new Installer backed by chartDir, which may refresh
+// the resolved chart directory in the background; see newChartSource.
+func newInstaller(tillerKubeClient *kube.Client, chartDir *chartSource, maxHistory int, timeout time.Duration, atomic bool) Installer {
+	return installer{tillerKubeClient, chartDir, maxHistory, timeout, atomic}
 }
 
 func getWatchesFile() (string, bool) {
@@ -0,0 +1,205 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api holds the status type written onto the custom resources
+// reconciled by the helm-app-operator installer.
+package api
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// Phase describes the current state of the Helm release backing the CR.
+type Phase string
+
+const (
+	// PhaseApplied indicates the release was successfully installed or
+	// updated.
+	PhaseApplied Phase = "Applied"
+	// PhaseFailed indicates the release failed to install or update.
+	PhaseFailed Phase = "Failed"
+)
+
+// Reason gives the reason for the most recent phase transition.
+type Reason string
+
+const (
+	// ReasonApplySuccessful indicates the install or update succeeded.
+	ReasonApplySuccessful Reason = "ApplySuccessful"
+	// ReasonApplyFailed indicates the install, update, or uninstall failed.
+	ReasonApplyFailed Reason = "ApplyFailed"
+	// ReasonRollbackSucceeded indicates an update failed and the release
+	// was successfully rolled back to its last deployed revision.
+	ReasonRollbackSucceeded Reason = "RollbackSucceeded"
+	// ReasonRollbackFailed indicates an update failed and the subsequent
+	// attempt to roll back to the last deployed revision also failed.
+	ReasonRollbackFailed Reason = "RollbackFailed"
+)
+
+// ConditionType is a valid value for Condition.Type.
+type ConditionType string
+
+const (
+	// ConditionInitialized indicates the release has been initialized in
+	// the storage backend.
+	ConditionInitialized ConditionType = "Initialized"
+	// ConditionDeployed indicates the release is currently deployed.
+	ConditionDeployed ConditionType = "Deployed"
+	// ConditionReleaseFailed indicates the most recent install, update, or
+	// uninstall of the release failed.
+	ConditionReleaseFailed ConditionType = "ReleaseFailed"
+	// ConditionIrreconcilable indicates the operator was unable to
+	// reconcile the release's underlying resources.
+	ConditionIrreconcilable ConditionType = "Irreconcilable"
+	// ConditionUninstalling indicates the release is in the process of
+	// being uninstalled.
+	ConditionUninstalling ConditionType = "Uninstalling"
+)
+
+// ConditionStatus is a valid value for Condition.Status.
+type ConditionStatus string
+
+const (
+	ConditionStatusTrue    ConditionStatus = "True"
+	ConditionStatusFalse   ConditionStatus = "False"
+	ConditionStatusUnknown ConditionStatus = "Unknown"
+)
+
+// Condition represents one point-in-time observation of the release's
+// state, modeled after Kubernetes' own condition conventions so that it
+// reads naturally alongside `kubectl wait --for=condition=...`.
+type Condition struct {
+	Type               ConditionType   `json:"type"`
+	Status             ConditionStatus `json:"status"`
+	Reason             Reason          `json:"reason,omitempty"`
+	Message            string          `json:"message,omitempty"`
+	LastTransitionTime metav1.Time     `json:"lastTransitionTime,omitempty"`
+}
+
+// HelmAppStatus is the status written back onto a CR reconciled by the
+// installer.
+type HelmAppStatus struct {
+	Release    *release.Release `json:"release,omitempty"`
+	Phase      Phase             `json:"phase,omitempty"`
+	Reason     Reason            `json:"reason,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Conditions []Condition       `json:"conditions,omitempty"`
+	// ObservedGeneration is the .metadata.generation InstallRelease last
+	// reconciled. A caller can compare it against the CR's current
+	// generation to tell whether spec has changed since, and skip the
+	// expensive dry-run update check when it hasn't.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// PendingRollbackRevision is set to the last known-good revision while
+	// a failed upgrade's rollback is in flight, so a crash or cancellation
+	// mid-rollback leaves a record for the next InstallRelease to detect and
+	// finish the rollback instead of leaving the release on a FAILED
+	// revision. It is cleared once the rollback resolves.
+	PendingRollbackRevision int32 `json:"pendingRollbackRevision,omitempty"`
+
+	// DependencyOrder is this GVK's position in the dependency-resolved
+	// startup order computed from watches.yaml's dependsOn entries (0 for
+	// the first GVK; a GVK always comes after every GVK it depends on).
+	DependencyOrder int `json:"dependencyOrder,omitempty"`
+	// WaitingOnDependencies lists the dependsOn GVKs, as
+	// "<group>/<version>, Kind=<kind>" strings, that don't yet have a
+	// Deployed release in this CR's namespace. While non-empty, the
+	// controller holds off installing or updating this release rather than
+	// risk racing a chart that assumes they already exist.
+	WaitingOnDependencies []string `json:"waitingOnDependencies,omitempty"`
+}
+
+// SetRelease sets the release on the status.
+func (s *HelmAppStatus) SetRelease(r *release.Release) {
+	s.Release = r
+}
+
+// SetPhase sets the phase, reason, and message on the status.
+func (s *HelmAppStatus) SetPhase(p Phase, r Reason, message string) {
+	s.Phase = p
+	s.Reason = r
+	s.Message = message
+}
+
+// SetObservedGeneration records generation as the .metadata.generation most
+// recently reconciled.
+func (s *HelmAppStatus) SetObservedGeneration(generation int64) {
+	s.ObservedGeneration = generation
+}
+
+// SetPendingRollbackRevision records revision as the last known-good
+// revision an in-flight rollback is targeting, or clears it when revision is
+// zero.
+func (s *HelmAppStatus) SetPendingRollbackRevision(revision int32) {
+	s.PendingRollbackRevision = revision
+}
+
+// SetDependencyOrder records order as this GVK's position in the
+// dependency-resolved startup order.
+func (s *HelmAppStatus) SetDependencyOrder(order int) {
+	s.DependencyOrder = order
+}
+
+// SetWaitingOnDependencies records the dependsOn GVKs, if any, that don't
+// yet have a Deployed release in this CR's namespace.
+func (s *HelmAppStatus) SetWaitingOnDependencies(waiting []string) {
+	s.WaitingOnDependencies = waiting
+}
+
+// SetCondition sets the given condition, updating LastTransitionTime only
+// when the condition's status actually changes, and overwriting any
+// existing condition of the same type.
+func (s *HelmAppStatus) SetCondition(condition Condition) {
+	condition.LastTransitionTime = metav1.Now()
+	for i, existing := range s.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		s.Conditions[i] = condition
+		return
+	}
+	s.Conditions = append(s.Conditions, condition)
+}
+
+// RemoveCondition removes the condition with the given type, if present.
+func (s *HelmAppStatus) RemoveCondition(conditionType ConditionType) {
+	for i, existing := range s.Conditions {
+		if existing.Type == conditionType {
+			s.Conditions = append(s.Conditions[:i], s.Conditions[i+1:]...)
+			return
+		}
+	}
+}
+
+// StatusFor extracts the HelmAppStatus from the given unstructured CR,
+// returning a zero-value status if one has not yet been set.
+func StatusFor(u *unstructured.Unstructured) *HelmAppStatus {
+	switch s := u.Object["status"].(type) {
+	case *HelmAppStatus:
+		return s
+	case map[string]interface{}:
+		var status HelmAppStatus
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(s, &status); err != nil {
+			return &HelmAppStatus{}
+		}
+		return &status
+	default:
+		return &HelmAppStatus{}
+	}
+}
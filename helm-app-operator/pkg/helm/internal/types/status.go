@@ -0,0 +1,184 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package types holds the status type written onto custom resources
+// reconciled by HelmOperatorReconciler.
+package types
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// HelmAppConditionType describes the state of a Helm release.
+type HelmAppConditionType string
+
+const (
+	// ConditionInitializing indicates the operator has begun managing the
+	// resource but has not yet installed or adopted a release.
+	ConditionInitializing HelmAppConditionType = "Initializing"
+	// ConditionIrreconcilable indicates the operator was unable to
+	// reconcile the release's underlying resources.
+	ConditionIrreconcilable HelmAppConditionType = "Irreconcilable"
+	// ConditionReleaseFailed indicates the most recent install, update, or
+	// uninstall of the release failed.
+	ConditionReleaseFailed HelmAppConditionType = "ReleaseFailed"
+	// ConditionDeployed indicates the release is currently deployed.
+	ConditionDeployed HelmAppConditionType = "Deployed"
+	// ConditionUninstalling indicates the release is in the process of
+	// being uninstalled, e.g. waiting for dependent resources to be
+	// removed from the cluster.
+	ConditionUninstalling HelmAppConditionType = "Uninstalling"
+	// ConditionValuesInvalid indicates the CR's spec failed validation
+	// against its chart's values.schema.json. The reconciler does not set
+	// this condition: a validation failure from PrepareRelease is reported
+	// as Irreconcilable and retried like any other PrepareRelease error.
+	ConditionValuesInvalid HelmAppConditionType = "ValuesInvalid"
+)
+
+// HelmAppConditionStatus is a valid value for HelmAppCondition.Status.
+type HelmAppConditionStatus string
+
+const (
+	StatusTrue    HelmAppConditionStatus = "True"
+	StatusFalse   HelmAppConditionStatus = "False"
+	StatusUnknown HelmAppConditionStatus = "Unknown"
+)
+
+// HelmAppConditionReason gives the reason for the most recent condition
+// transition.
+type HelmAppConditionReason string
+
+const (
+	ReasonInstallError        HelmAppConditionReason = "InstallError"
+	ReasonInstallSuccessful   HelmAppConditionReason = "InstallSuccessful"
+	ReasonUpdateError         HelmAppConditionReason = "UpdateError"
+	ReasonUpdateSuccessful    HelmAppConditionReason = "UpdateSuccessful"
+	ReasonReconcileError      HelmAppConditionReason = "ReconcileError"
+	ReasonUninstallError      HelmAppConditionReason = "UninstallError"
+	ReasonUninstallSuccessful HelmAppConditionReason = "UninstallSuccessful"
+	ReasonInvalidValues       HelmAppConditionReason = "InvalidValues"
+)
+
+// ReleaseInfo is a point-in-time, backend-neutral snapshot of a Helm
+// release, carrying only what's useful to display on a CR's status
+// regardless of whether the Tiller (Helm v2) or action (Helm v3) backend
+// produced the release.
+type ReleaseInfo struct {
+	Name         string `json:"name,omitempty"`
+	Manifest     string `json:"manifest,omitempty"`
+	Notes        string `json:"notes,omitempty"`
+	ChartName    string `json:"chartName,omitempty"`
+	ChartVersion string `json:"chartVersion,omitempty"`
+}
+
+// HelmAppCondition represents one point-in-time observation of the
+// release's state.
+type HelmAppCondition struct {
+	Type               HelmAppConditionType   `json:"type"`
+	Status             HelmAppConditionStatus `json:"status"`
+	Reason             HelmAppConditionReason `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Release            *ReleaseInfo           `json:"release,omitempty"`
+}
+
+// HelmAppStatus is the status written back onto a CR reconciled by
+// HelmOperatorReconciler.
+type HelmAppStatus struct {
+	Conditions []HelmAppCondition `json:"conditions,omitempty"`
+	// DeployedRelease mirrors the Release on the current Deployed condition,
+	// so a caller (e.g. `kubectl get -o jsonpath`) can read the chart
+	// version and rendered NOTES.txt for the release currently live without
+	// walking the conditions array to find it. It is cleared once the
+	// release is uninstalled.
+	DeployedRelease *ReleaseInfo `json:"deployedRelease,omitempty"`
+	// ObservedGeneration is the .metadata.generation Reconcile last wrote
+	// this status for, letting a caller compare it against the CR's current
+	// generation to tell whether a spec change is still awaiting reconcile.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// SetObservedGeneration records generation as the .metadata.generation this
+// status was last computed for.
+func (s *HelmAppStatus) SetObservedGeneration(generation int64) *HelmAppStatus {
+	s.ObservedGeneration = generation
+	return s
+}
+
+// SetDeployedRelease records rel as the most recently deployed release, or
+// clears it if rel is nil.
+func (s *HelmAppStatus) SetDeployedRelease(rel *ReleaseInfo) *HelmAppStatus {
+	s.DeployedRelease = rel
+	return s
+}
+
+// SetCondition sets the given condition, updating LastTransitionTime only
+// when the condition's status actually changes, and overwriting any
+// existing condition of the same type.
+func (s *HelmAppStatus) SetCondition(condition HelmAppCondition) *HelmAppStatus {
+	condition.LastTransitionTime = metav1.Now()
+	for i, existing := range s.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		s.Conditions[i] = condition
+		return s
+	}
+	s.Conditions = append(s.Conditions, condition)
+	return s
+}
+
+// GetCondition returns a pointer to the condition with the given type, or
+// nil if the status does not have one.
+func (s *HelmAppStatus) GetCondition(conditionType HelmAppConditionType) *HelmAppCondition {
+	for i, existing := range s.Conditions {
+		if existing.Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// RemoveCondition removes the condition with the given type, if present.
+func (s *HelmAppStatus) RemoveCondition(conditionType HelmAppConditionType) *HelmAppStatus {
+	for i, existing := range s.Conditions {
+		if existing.Type == conditionType {
+			s.Conditions = append(s.Conditions[:i], s.Conditions[i+1:]...)
+			return s
+		}
+	}
+	return s
+}
+
+// StatusFor extracts the HelmAppStatus from the given unstructured CR,
+// returning a zero-value status if one has not yet been set.
+func StatusFor(u *unstructured.Unstructured) *HelmAppStatus {
+	switch s := u.Object["status"].(type) {
+	case *HelmAppStatus:
+		return s
+	case map[string]interface{}:
+		var status HelmAppStatus
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(s, &status); err != nil {
+			return &HelmAppStatus{}
+		}
+		return &status
+	default:
+		return &HelmAppStatus{}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package util holds small helpers shared by the release and controller
+// packages.
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ResourceString returns a log-friendly identifier for an unstructured
+// resource.
+func ResourceString(r *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s/%s (%s)", r.GetNamespace(), r.GetName(), r.GroupVersionKind())
+}
+
+// Diff returns a human-readable summary of the lines added and removed
+// between two rendered manifests, for logging what a release installation,
+// update, or uninstallation changed.
+func Diff(before, after string) string {
+	beforeLines := splitNonEmpty(before)
+	afterLines := splitNonEmpty(after)
+
+	beforeSet := make(map[string]bool, len(beforeLines))
+	for _, l := range beforeLines {
+		beforeSet[l] = true
+	}
+	afterSet := make(map[string]bool, len(afterLines))
+	for _, l := range afterLines {
+		afterSet[l] = true
+	}
+
+	var b strings.Builder
+	for _, l := range beforeLines {
+		if !afterSet[l] {
+			fmt.Fprintf(&b, "-%s\n", l)
+		}
+	}
+	for _, l := range afterLines {
+		if !beforeSet[l] {
+			fmt.Fprintf(&b, "+%s\n", l)
+		}
+	}
+	return b.String()
+}
+
+func splitNonEmpty(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides the Prometheus instrumentation shared by the
+// release manager and its reconciler, so Helm-based operators get SLO-grade
+// visibility without hand-rolling exporters.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Action identifies which Helm action a latency observation or outcome
+// counter belongs to.
+type Action string
+
+const (
+	ActionInstall   Action = "install"
+	ActionUpgrade   Action = "upgrade"
+	ActionUninstall Action = "uninstall"
+	ActionReconcile Action = "reconcile"
+)
+
+// Outcome is a valid value for the "outcome" label on ActionsTotal.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// Metrics holds the Prometheus collectors instrumenting a Helm-based
+// operator. Use New to build one registered against a specific registerer,
+// or Default for the collectors registered against controller-runtime's
+// global metrics.Registry.
+type Metrics struct {
+	// ActionsTotal counts each Helm action the manager performs, partitioned
+	// by gvk, action, and outcome.
+	ActionsTotal *prometheus.CounterVec
+	// ActionDuration observes the wall-clock latency of each Helm action,
+	// partitioned by gvk and action.
+	ActionDuration *prometheus.HistogramVec
+	// ReleaseCondition gauges the number of custom resources currently
+	// reporting each HelmAppCondition type/status, partitioned by gvk.
+	ReleaseCondition *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	last map[conditionKey]string // last observed status per CR+condition type
+}
+
+// conditionKey identifies one CR's observations of one HelmAppCondition type.
+type conditionKey struct {
+	gvk            schema.GroupVersionKind
+	namespacedName types.NamespacedName
+	conditionType  string
+}
+
+// New builds a Metrics and registers its collectors against reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		ActionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "helm_operator_actions_total",
+			Help: "Number of Helm actions performed, by GVK, action, and outcome.",
+		}, []string{"gvk", "action", "outcome"}),
+		ActionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "helm_operator_action_duration_seconds",
+			Help:    "Wall-clock latency of Helm actions, by GVK and action.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"gvk", "action"}),
+		ReleaseCondition: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "helm_operator_release_condition",
+			Help: "Number of custom resources currently reporting each HelmAppCondition, by GVK, condition type, and status.",
+		}, []string{"gvk", "type", "status"}),
+		last: map[conditionKey]string{},
+	}
+	reg.MustRegister(m.ActionsTotal, m.ActionDuration, m.ReleaseCondition)
+	return m
+}
+
+// Default is registered against controller-runtime's global metrics.Registry,
+// which is already served by the operator's metrics endpoint. It is used
+// whenever a ManagerFactory or HelmOperatorReconciler is not given its own
+// Metrics via an explicit option.
+var Default = New(crmetrics.Registry)
+
+// ObserveAction records the outcome and latency of a Helm action for gvk.
+func (m *Metrics) ObserveAction(gvk schema.GroupVersionKind, action Action, start time.Time, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+	m.ActionsTotal.WithLabelValues(gvk.String(), string(action), string(outcome)).Inc()
+	m.ActionDuration.WithLabelValues(gvk.String(), string(action)).Observe(time.Since(start).Seconds())
+}
+
+// SetCondition records that the CR identified by gvk/namespacedName now
+// reports status for conditionType, moving the ReleaseCondition gauge off of
+// whatever status it previously reported (if any) for that condition type.
+// Call with an empty status to record that the CR no longer reports
+// conditionType at all.
+func (m *Metrics) SetCondition(gvk schema.GroupVersionKind, namespacedName types.NamespacedName, conditionType, status string) {
+	key := conditionKey{gvk: gvk, namespacedName: namespacedName, conditionType: conditionType}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, had := m.last[key]
+	if had && previous == status {
+		return
+	}
+	if had {
+		m.ReleaseCondition.WithLabelValues(gvk.String(), conditionType, previous).Dec()
+	}
+	if status == "" {
+		delete(m.last, key)
+		return
+	}
+	m.ReleaseCondition.WithLabelValues(gvk.String(), conditionType, status).Inc()
+	m.last[key] = status
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// DefaultUninstallWaitAnnotation, when set to "true" on the watched CR,
+	// makes the caller poll Manager.AwaitingDependentResourceRemoval after
+	// UninstallRelease returns, requeueing until every resource in the
+	// release's manifest is removed from the cluster before it strips the
+	// uninstall-helm-release finalizer. UninstallRelease itself does not wait.
+	DefaultUninstallWaitAnnotation = "helm.sdk.operatorframework.io/uninstall-wait"
+	// DefaultUpgradeForceAnnotation, when set to "true" on the watched CR,
+	// passes Force semantics into UpdateRelease.
+	DefaultUpgradeForceAnnotation = "helm.sdk.operatorframework.io/upgrade-force"
+	// DefaultInstallTimeoutAnnotation sets, in seconds, how long Tiller
+	// waits for an install to complete.
+	DefaultInstallTimeoutAnnotation = "helm.sdk.operatorframework.io/install-timeout"
+	// DefaultUpgradeTimeoutAnnotation sets, in seconds, how long Tiller
+	// waits for an upgrade to complete.
+	DefaultUpgradeTimeoutAnnotation = "helm.sdk.operatorframework.io/upgrade-timeout"
+)
+
+// AnnotationSet maps the per-CR behavior a manager understands to the
+// annotation keys that configure it. Downstream operators that need
+// different (or additional) annotation names can build their own
+// AnnotationSet instead of being locked into the
+// helm.sdk.operatorframework.io/* defaults.
+type AnnotationSet struct {
+	UninstallWait  string
+	UpgradeForce   string
+	InstallTimeout string
+	UpgradeTimeout string
+}
+
+// DefaultAnnotationSet is the AnnotationSet used by NewManagerFactory.
+var DefaultAnnotationSet = AnnotationSet{
+	UninstallWait:  DefaultUninstallWaitAnnotation,
+	UpgradeForce:   DefaultUpgradeForceAnnotation,
+	InstallTimeout: DefaultInstallTimeoutAnnotation,
+	UpgradeTimeout: DefaultUpgradeTimeoutAnnotation,
+}
+
+// InstallOptions tunes per-release Helm behavior, populated from the
+// annotations on the watched CR.
+type InstallOptions struct {
+	UninstallWait  bool
+	UpgradeForce   bool
+	InstallTimeout int64
+	UpgradeTimeout int64
+}
+
+// optionsFor extracts InstallOptions from u's annotations, according to a.
+// Annotation values that fail to parse are ignored, leaving the
+// corresponding option at its zero value.
+func (a AnnotationSet) optionsFor(u *unstructured.Unstructured) InstallOptions {
+	ann := u.GetAnnotations()
+	var opts InstallOptions
+	if v, ok := ann[a.UninstallWait]; ok {
+		opts.UninstallWait, _ = strconv.ParseBool(v)
+	}
+	if v, ok := ann[a.UpgradeForce]; ok {
+		opts.UpgradeForce, _ = strconv.ParseBool(v)
+	}
+	if v, ok := ann[a.InstallTimeout]; ok {
+		opts.InstallTimeout, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := ann[a.UpgradeTimeout]; ok {
+		opts.UpgradeTimeout, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return opts
+}
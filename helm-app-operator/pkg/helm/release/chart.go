@@ -0,0 +1,95 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/downloader"
+	"k8s.io/helm/pkg/getter"
+	helmenv "k8s.io/helm/pkg/helm/environment"
+)
+
+const (
+	// HelmChartCacheDirEnvVar overrides the directory used to cache charts
+	// resolved from a remote Helm repository instead of a local directory
+	// baked into the image.
+	HelmChartCacheDirEnvVar = "HELM_CHART_CACHE_DIR"
+
+	defaultHelmChartCacheDir = "/opt/helm/chart-cache"
+)
+
+// resolveRepoChartDir downloads chartName at version (a version or, per
+// Helm's own SemVer range syntax, a version constraint such as "~1.2.0")
+// from the Helm chart repository at repoURL, caching the result so repeated
+// resolutions of the same chart+version reuse the cache instead of
+// re-downloading each time. It's the release package's analogue of
+// installer.resolveChartDir's repo case.
+func resolveRepoChartDir(repoURL, chartName, version string) (string, error) {
+	cacheDir := helmChartCacheDir()
+	dest := chartCacheDirFor(cacheDir, fmt.Sprintf("%s/%s@%s", repoURL, chartName, version))
+	if entries, err := ioutil.ReadDir(filepath.Join(dest, "expanded")); err == nil && len(entries) == 1 {
+		return filepath.Join(dest, "expanded", entries[0].Name()), nil
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", fmt.Errorf("failed to create chart cache dir: %s", err)
+	}
+
+	dl := downloader.ChartDownloader{
+		Out:     os.Stdout,
+		Getters: getter.All(helmenv.EnvSettings{}),
+	}
+	chartRef := fmt.Sprintf("%s/%s", repoURL, chartName)
+	archive, verification, err := dl.DownloadTo(chartRef, version, dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to download chart %s (version %s) from %s: %s", chartName, version, repoURL, err)
+	}
+	if verification != nil {
+		log.Printf("verified provenance for chart %s: %s", chartName, verification.FileHash)
+	}
+
+	c, err := chartutil.Load(archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to load downloaded chart %s: %s", archive, err)
+	}
+	expandDir := filepath.Join(filepath.Dir(archive), "expanded")
+	if err := chartutil.SaveDir(c, expandDir); err != nil {
+		return "", fmt.Errorf("failed to expand chart into %s: %s", expandDir, err)
+	}
+	return filepath.Join(expandDir, c.GetMetadata().GetName()), nil
+}
+
+func helmChartCacheDir() string {
+	if dir := os.Getenv(HelmChartCacheDirEnvVar); dir != "" {
+		return dir
+	}
+	return defaultHelmChartCacheDir
+}
+
+func chartCacheDirFor(cacheDir, ref string) string {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(ref)))
+	return filepath.Join(cacheDir, digest)
+}
+
+func chartIsCached(dest string) bool {
+	entries, err := ioutil.ReadDir(dest)
+	return err == nil && len(entries) > 0
+}
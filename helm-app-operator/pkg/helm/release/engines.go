@@ -0,0 +1,40 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	helmengine "k8s.io/helm/pkg/engine"
+	"k8s.io/helm/pkg/tiller/environment"
+)
+
+// EngineFactory builds the base rendering engine a chart should use when its
+// Chart.yaml declares the associated name in its engine field. ownerRefs is
+// passed through so factories that need to be ownerRef-aware can use it, but
+// tillerRendererForCR always wraps the returned engine in OwnerRefEngine
+// itself, so every registered engine gets CR ownerRef injection whether or
+// not its factory does anything with ownerRefs.
+type EngineFactory func(ownerRefs []metav1.OwnerReference) environment.Engine
+
+// defaultEngines seeds a managerFactory's engine registry with the standard
+// Helm go template engine under environment.GoTplEngine, the name charts
+// use implicitly when Chart.yaml omits an engine field.
+func defaultEngines() map[string]EngineFactory {
+	return map[string]EngineFactory{
+		environment.GoTplEngine: func(_ []metav1.OwnerReference) environment.Engine {
+			return helmengine.New()
+		},
+	}
+}
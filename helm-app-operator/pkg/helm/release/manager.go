@@ -21,18 +21,21 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
-	"github.com/martinlindhe/base36"
-	"github.com/pborman/uuid"
-	"github.com/sirupsen/logrus"
+	"github.com/go-logr/logr"
 
 	yaml "gopkg.in/yaml.v2"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/helm/pkg/chartutil"
-	helmengine "k8s.io/helm/pkg/engine"
 	"k8s.io/helm/pkg/kube"
 	cpb "k8s.io/helm/pkg/proto/hapi/chart"
 	rpb "k8s.io/helm/pkg/proto/hapi/release"
@@ -42,28 +45,66 @@ import (
 	"k8s.io/helm/pkg/tiller/environment"
 	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 	"k8s.io/kubernetes/pkg/kubectl/genericclioptions/resource"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/engine"
 	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/types"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/metrics"
 )
 
+// lastAppliedConfigAnnotation records the manifest a rendered resource was
+// last reconciled with, the way `kubectl apply` does, so ReconcileRelease can
+// three-way-merge the operator's own last write, the release's current
+// expected state, and whatever is live, instead of diffing the live object
+// against itself and silently clobbering fields other controllers manage.
+const lastAppliedConfigAnnotation = "helm.sh/last-applied-configuration"
+
 var (
 	// ErrNotFound indicates that a release could not be found
 	ErrNotFound = errors.New("release not found")
 )
 
+// defaultLog is used by manager whenever no logger was configured for it.
+var defaultLog = logf.Log.WithName("helm.release")
+
 // Manager can install and uninstall Helm releases given a custom resource
 // which provides runtime values for the Chart.
 type Manager interface {
-	Sync() error
+	Sync(ctx context.Context) error
 	GetReleaseName() string
 	PrepareRelease(context.Context) error
-	InstallRelease(context.Context) (*rpb.Release, error)
-	UpdateRelease(context.Context) (*rpb.Release, *rpb.Release, error)
-	ReconcileRelease(context.Context) (*rpb.Release, error)
-	UninstallRelease(context.Context) (*rpb.Release, error)
+	InstallRelease(context.Context) (Release, error)
+	UpdateRelease(context.Context) (Release, Release, error)
+	// ReconcileRelease reconciles the release's rendered resources against
+	// the live cluster state and returns a human-readable, per-resource diff
+	// of whatever drift it corrected, or "" if nothing needed to change.
+	ReconcileRelease(context.Context) (Release, string, error)
+	UninstallRelease(context.Context) (Release, error)
 	IsReleaseInstalled() bool
 	IsUpdateRequired() bool
+
+	// ReleaseStatus returns the Tiller status code of this release's most
+	// recent revision (not necessarily the currently Deployed one) and the
+	// description Tiller recorded for it (the failure reason, when that
+	// revision failed). Called before Sync, it lets a caller surface a
+	// revision that Sync's non-deployed-revision cleanup is about to delete
+	// onto the CR's status instead of only logging it.
+	ReleaseStatus(ctx context.Context) (*rpb.Status, string, error)
+
+	// UninstallWaitEnabled reports whether the CR this manager was created
+	// for carries the uninstall-wait annotation, so the caller knows
+	// whether to poll AwaitingDependentResourceRemoval before removing its
+	// finalizer.
+	UninstallWaitEnabled() bool
+	// AwaitingDependentResourceRemoval reports whether any resource listed
+	// in manifest is still present in the cluster.
+	AwaitingDependentResourceRemoval(ctx context.Context, manifest string) (bool, error)
+
+	// GetLogger returns the logger this Manager records release events
+	// against, so a caller can derive its own log lines (e.g. reconcile
+	// results) with the same release/namespace/name context already
+	// attached.
+	GetLogger() logr.Logger
 }
 
 type manager struct {
@@ -74,9 +115,15 @@ type manager struct {
 
 	namespace   string
 	releaseName string
+	gvk         schema.GroupVersionKind
 
-	spec   interface{}
-	status *types.HelmAppStatus
+	spec         interface{}
+	status       *types.HelmAppStatus
+	installOpts  InstallOptions
+	postRenderFn PostRendererFn
+	metrics      *metrics.Metrics
+	engines      map[string]EngineFactory
+	logger       logr.Logger
 
 	chart  *cpb.Chart
 	config *cpb.Config
@@ -86,23 +133,47 @@ type manager struct {
 	deployedRelease    *rpb.Release
 }
 
-func newManagerForCR(storageBackend *storage.Storage, tillerKubeClient *kube.Client, chartDir string, u *unstructured.Unstructured) Manager {
+func newManagerForCR(storageBackend *storage.Storage, tillerKubeClient *kube.Client, chartDir string, annotations AnnotationSet, postRenderFn PostRendererFn, mtx *metrics.Metrics, engines map[string]EngineFactory, logger logr.Logger, namer ReleaseNamer, u *unstructured.Unstructured) Manager {
+	if mtx == nil {
+		mtx = metrics.Default
+	}
+	if engines == nil {
+		engines = defaultEngines()
+	}
+	if logger == nil {
+		logger = defaultLog
+	}
+	if namer == nil {
+		namer = DefaultReleaseNamer{}
+	}
+	releaseName := GetReleaseName(namer, u)
 	m := &manager{
 		storageBackend:   storageBackend,
 		tillerKubeClient: tillerKubeClient,
 		chartDir:         chartDir,
 		namespace:        u.GetNamespace(),
-		releaseName:      releaseNameForCR(u),
+		releaseName:      releaseName,
+		gvk:              u.GroupVersionKind(),
 		spec:             u.Object["spec"],
 		status:           types.StatusFor(u),
+		installOpts:      annotations.optionsFor(u),
+		postRenderFn:     postRenderFn,
+		metrics:          mtx,
+		engines:          engines,
+		logger:           logger.WithValues("release", releaseName, "namespace", u.GetNamespace()),
 	}
 	m.tiller = m.tillerRendererForCR(u)
 	return m
 }
 
+// GetLogger returns the logger this manager records release events against.
+func (c manager) GetLogger() logr.Logger {
+	return c.logger
+}
+
 // Sync ensures that the resource status is synced with the tiller storage
 // backend.
-func (c manager) Sync() error {
+func (c manager) Sync(ctx context.Context) error {
 	if c.status.Release != nil {
 		name := c.status.Release.GetName()
 		version := c.status.Release.GetVersion()
@@ -135,6 +206,30 @@ func (c manager) Sync() error {
 	return nil
 }
 
+// ReleaseStatus returns the Tiller status code of this release's most
+// recent revision, by version, and the description Tiller recorded for it
+// (the failure reason, when the code is FAILED).
+func (c manager) ReleaseStatus(ctx context.Context) (*rpb.Status, string, error) {
+	history, err := c.storageBackend.History(c.releaseName)
+	if err != nil {
+		if notFoundErr(err) {
+			return &rpb.Status{Code: rpb.Status_UNKNOWN}, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get release history: %s", err)
+	}
+	if len(history) == 0 {
+		return &rpb.Status{Code: rpb.Status_UNKNOWN}, "", nil
+	}
+
+	latest := history[0]
+	for _, rel := range history[1:] {
+		if rel.GetVersion() > latest.GetVersion() {
+			latest = rel
+		}
+	}
+	return latest.GetInfo().GetStatus(), latest.GetInfo().GetDescription(), nil
+}
+
 func notFoundErr(err error) bool {
 	return strings.Contains(err.Error(), "not found")
 }
@@ -189,12 +284,15 @@ func (c *manager) PrepareRelease(ctx context.Context) error {
 // InstallRelease installs a new Helm release. If an installation error occurs,
 // this method will attempt to uninstall the release and return the underlying
 // error.
-func (c manager) InstallRelease(ctx context.Context) (*rpb.Release, error) {
+func (c manager) InstallRelease(ctx context.Context) (rel Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionInstall, start, err) }(time.Now())
+
 	installReq := &services.InstallReleaseRequest{
 		Namespace: c.namespace,
 		Name:      c.releaseName,
 		Chart:     c.chart,
 		Values:    c.config,
+		Timeout:   c.installOpts.InstallTimeout,
 	}
 
 	releaseResponse, err := c.tiller.InstallRelease(ctx, installReq)
@@ -207,22 +305,29 @@ func (c manager) InstallRelease(ctx context.Context) (*rpb.Release, error) {
 			}
 			_, uninstallErr := c.tiller.UninstallRelease(ctx, uninstallReq)
 			if uninstallErr != nil {
+				c.logger.Error(uninstallErr, "Failed to roll back failed installation", "cause", err)
 				return nil, fmt.Errorf("failed to roll back failed installation: %s: %s", uninstallErr, err)
 			}
 		}
+		c.logger.Error(err, "Failed to install release")
 		return nil, err
 	}
-	return releaseResponse.GetRelease(), nil
+	c.logger.Info("Installed release", "revision", releaseResponse.GetRelease().GetVersion())
+	return wrapTillerRelease(releaseResponse.GetRelease()), nil
 }
 
 // UpdateRelease updates an existing Helm release. If an update error occurs,
 // this method will attempt to rollback the release and return the underlying
 // error.
-func (c manager) UpdateRelease(ctx context.Context) (*rpb.Release, *rpb.Release, error) {
+func (c manager) UpdateRelease(ctx context.Context) (previous Release, updated Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionUpgrade, start, err) }(time.Now())
+
 	updateReq := &services.UpdateReleaseRequest{
-		Name:   c.releaseName,
-		Chart:  c.chart,
-		Values: c.config,
+		Name:    c.releaseName,
+		Chart:   c.chart,
+		Values:  c.config,
+		Force:   c.installOpts.UpgradeForce,
+		Timeout: c.installOpts.UpgradeTimeout,
 	}
 
 	releaseResponse, err := c.tiller.UpdateRelease(ctx, updateReq)
@@ -235,55 +340,167 @@ func (c manager) UpdateRelease(ctx context.Context) (*rpb.Release, *rpb.Release,
 			}
 			_, rollbackErr := c.tiller.RollbackRelease(ctx, rollbackReq)
 			if rollbackErr != nil {
+				c.logger.Error(rollbackErr, "Failed to roll back failed update", "cause", err)
 				return nil, nil, fmt.Errorf("failed to roll back failed update: %s: %s", rollbackErr, err)
 			}
+			c.logger.Info("Rolled back failed update", "revision", c.deployedRelease.GetVersion(), "cause", err)
 		}
+		c.logger.Error(err, "Failed to update release")
 		return nil, nil, err
 	}
-	return c.deployedRelease, releaseResponse.GetRelease(), nil
+	c.logger.Info("Updated release", "revision", releaseResponse.GetRelease().GetVersion())
+	return wrapTillerRelease(c.deployedRelease), wrapTillerRelease(releaseResponse.GetRelease()), nil
 }
 
 // ReconcileRelease reconciles the underlying resources of an existing Helm
-// release. If an error occurs, it will be returned.
-func (c manager) ReconcileRelease(ctx context.Context) (*rpb.Release, error) {
+// release. Each resource is three-way merged between its
+// lastAppliedConfigAnnotation, the release's expected manifest, and the live
+// object, so that fields owned by other controllers (HPA-managed replicas, a
+// Service's clusterIP, etc.) survive reconciliation. It returns a
+// human-readable, per-resource summary of whatever drift it corrected, or ""
+// if nothing needed to change. If an error occurs, it will be returned.
+func (c manager) ReconcileRelease(ctx context.Context) (rel Release, diff string, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionReconcile, start, err) }(time.Now())
+
 	expectedInfos, err := c.tillerKubeClient.BuildUnstructured(c.namespace, bytes.NewBufferString(c.deployedRelease.GetManifest()))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+
+	var diffs []string
 	err = expectedInfos.Visit(func(expected *resource.Info, err error) error {
 		if err != nil {
 			return err
 		}
-		helper := resource.NewHelper(expected.Client, expected.Mapping)
-		_, err = helper.Create(expected.Namespace, true, expected.Object)
-		if err == nil {
-			return nil
+		resourceDiff, err := reconcileObject(expected)
+		if err != nil {
+			return fmt.Errorf("failed reconciling %s: %s", infoKey(expected), err)
 		}
-		if !apierrors.IsAlreadyExists(err) {
-			return fmt.Errorf("create error: %s", err)
+		if resourceDiff != "" {
+			diffs = append(diffs, fmt.Sprintf("%s:\n%s", infoKey(expected), resourceDiff))
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapTillerRelease(c.deployedRelease), strings.Join(diffs, "\n"), nil
+}
 
-		patch, err := json.Marshal(expected.Object)
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON patch: %s", err)
+// infoKey uniquely identifies a resource.Info by GVK, namespace, and name so
+// it can be used in a diff report.
+func infoKey(info *resource.Info) string {
+	gvk := info.Mapping.GroupVersionKind
+	return fmt.Sprintf("%s/%s/%s/%s", gvk.GroupVersion(), gvk.Kind, info.Namespace, info.Name)
+}
+
+// reconcileObject brings the live object for expected in line with expected,
+// stamping expected with lastAppliedConfigAnnotation before every create or
+// patch so the next reconcile has something to three-way-merge against. It
+// returns the patch it applied, or "" if the object was just created or
+// nothing needed to change.
+func reconcileObject(expected *resource.Info) (string, error) {
+	u, ok := expected.Object.(*unstructured.Unstructured)
+	if !ok {
+		return "", fmt.Errorf("expected object %T is not unstructured", expected.Object)
+	}
+	helper := resource.NewHelper(expected.Client, expected.Mapping)
+
+	rawExpectedJSON, err := json.Marshal(u.Object)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal expected object: %s", err)
+	}
+	setLastAppliedConfig(u, rawExpectedJSON)
+
+	live, err := helper.Get(expected.Namespace, expected.Name, false)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to get live object: %s", err)
+		}
+		if _, err := helper.Create(expected.Namespace, true, expected.Object); err != nil {
+			return "", fmt.Errorf("failed to create object: %s", err)
 		}
+		return "", nil
+	}
+
+	acc, err := meta.Accessor(live)
+	if err != nil {
+		return "", fmt.Errorf("failed to get live object metadata: %s", err)
+	}
+	originalJSON := []byte(acc.GetAnnotations()[lastAppliedConfigAnnotation])
+	if len(originalJSON) == 0 {
+		originalJSON = []byte("{}")
+	}
 
-		_, err = helper.Patch(expected.Namespace, expected.Name, apitypes.MergePatchType, patch)
+	liveJSON, err := json.Marshal(live)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal live object: %s", err)
+	}
+	expectedJSON, err := json.Marshal(u.Object)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal expected object: %s", err)
+	}
+
+	patch, patchType, err := threeWayMergePatch(expected.Mapping.GroupVersionKind, originalJSON, expectedJSON, liveJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute patch: %s", err)
+	}
+	if patch == nil {
+		return "", nil
+	}
+
+	if _, err := helper.Patch(expected.Namespace, expected.Name, patchType, patch); err != nil {
+		return "", fmt.Errorf("failed to patch object: %s", err)
+	}
+	return string(patch), nil
+}
+
+// setLastAppliedConfig stamps u with rawJSON, the manifest it is about to be
+// applied with, the way `kubectl apply` does, so a later ReconcileRelease can
+// three-way-merge against what the operator itself last wrote instead of
+// diffing the live object against itself.
+func setLastAppliedConfig(u *unstructured.Unstructured, rawJSON []byte) {
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastAppliedConfigAnnotation] = string(rawJSON)
+	u.SetAnnotations(annotations)
+}
+
+// threeWayMergePatch computes a patch that applies the changes made between
+// original and expected onto live, using a strategic merge patch for
+// built-in kinds registered in the client-go scheme and falling back to a
+// JSON merge patch for CRDs and other unregistered kinds. A nil patch means
+// the computed diff is empty and the caller can skip the API call.
+func threeWayMergePatch(gvk schema.GroupVersionKind, originalJSON, expectedJSON, liveJSON []byte) ([]byte, apitypes.PatchType, error) {
+	var patch []byte
+	var patchType apitypes.PatchType
+	if versioned, err := scheme.Scheme.New(gvk); err == nil {
+		patch, err = strategicpatch.CreateThreeWayMergePatch(originalJSON, expectedJSON, liveJSON, versioned, true)
 		if err != nil {
-			return fmt.Errorf("patch error: %s", err)
+			return nil, "", fmt.Errorf("failed to create strategic merge patch: %s", err)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		patchType = apitypes.StrategicMergePatchType
+	} else {
+		patch, err = jsonmergepatch.CreateThreeWayJSONMergePatch(originalJSON, expectedJSON, liveJSON)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create JSON merge patch: %s", err)
+		}
+		patchType = apitypes.MergePatchType
+	}
+	if string(patch) == "{}" {
+		return nil, "", nil
 	}
-	return c.deployedRelease, nil
+	return patch, patchType, nil
 }
 
 // UninstallRelease uninstalls the Helm release based on the passed in object.
 // If no release exists for the object, ErrNotFound will be returned. If an
 // uninstall error occurs, it will be returned.
-func (c manager) UninstallRelease(ctx context.Context) (*rpb.Release, error) {
+func (c manager) UninstallRelease(ctx context.Context) (rel Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionUninstall, start, err) }(time.Now())
+
 	// Get history of this release
 	h, err := c.storageBackend.History(c.releaseName)
 	if err != nil {
@@ -299,7 +516,12 @@ func (c manager) UninstallRelease(ctx context.Context) (*rpb.Release, error) {
 		Name:  c.releaseName,
 		Purge: true,
 	})
-	return uninstallResponse.GetRelease(), err
+	if err != nil {
+		c.logger.Error(err, "Failed to uninstall release")
+		return nil, err
+	}
+	c.logger.Info("Uninstalled release", "revision", uninstallResponse.GetRelease().GetVersion())
+	return wrapTillerRelease(uninstallResponse.GetRelease()), nil
 }
 
 // IsReleaseInstalled returns whether a release is installed. This method must
@@ -314,6 +536,40 @@ func (c manager) IsUpdateRequired() bool {
 	return c.isUpdateRequired
 }
 
+// UninstallWaitEnabled reports whether the CR this manager was created for
+// carries the uninstall-wait annotation.
+func (c manager) UninstallWaitEnabled() bool {
+	return c.installOpts.UninstallWait
+}
+
+// AwaitingDependentResourceRemoval reports whether any resource listed in
+// manifest is still present in the cluster, so a caller honoring
+// uninstall-wait knows whether it's safe to remove its finalizer.
+func (c manager) AwaitingDependentResourceRemoval(ctx context.Context, manifest string) (bool, error) {
+	infos, err := c.tillerKubeClient.BuildUnstructured(c.namespace, bytes.NewBufferString(manifest))
+	if err != nil {
+		return false, fmt.Errorf("failed building unstructured objects for uninstalled release: %s", err)
+	}
+
+	remaining := false
+	err = infos.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		helper := resource.NewHelper(info.Client, info.Mapping)
+		if _, getErr := helper.Get(info.Namespace, info.Name, false); getErr == nil {
+			remaining = true
+		} else if !apierrors.IsNotFound(getErr) {
+			return getErr
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed checking for remaining dependent resources: %s", err)
+	}
+	return remaining, nil
+}
+
 func (c manager) loadChartAndConfig() (*cpb.Chart, *cpb.Config, error) {
 	// chart is mutated by the call to processRequirements,
 	// so we need to reload it from disk every time.
@@ -326,8 +582,11 @@ func (c manager) loadChartAndConfig() (*cpb.Chart, *cpb.Config, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to parse values: %s", err)
 	}
+	if err := validateValuesAgainstSchema(chart, cr); err != nil {
+		return nil, nil, err
+	}
 	config := &cpb.Config{Raw: string(cr)}
-	logrus.Debug("Using values: %s", config.GetRaw())
+	c.logger.V(1).Info("Using values", "chart", chart.GetMetadata().GetName(), "values", config.GetRaw())
 
 	err = processRequirements(chart, config)
 	if err != nil {
@@ -362,17 +621,22 @@ func (c manager) getDeployedRelease() (*rpb.Release, error) {
 	return deployedRelease, nil
 }
 
-// tillerRendererForCR creates a ReleaseServer configured with a rendering engine that adds ownerrefs to rendered assets
-// based on the CR.
+// tillerRendererForCR creates a ReleaseServer whose EngineYard holds every
+// engine in c.engines, each wrapped in OwnerRefEngine (so rendered assets
+// get ownerrefs to the CR regardless of which engine a chart's Chart.yaml
+// selects) and in the configured post-renderer. Tiller picks among them at
+// render time by looking up the chart's Chart.yaml engine field, falling
+// back to environment.GoTplEngine.
 func (c manager) tillerRendererForCR(r *unstructured.Unstructured) *tiller.ReleaseServer {
 	controllerRef := metav1.NewControllerRef(r, r.GroupVersionKind())
 	ownerRefs := []metav1.OwnerReference{
 		*controllerRef,
 	}
-	baseEngine := helmengine.New()
-	e := engine.NewOwnerRefEngine(baseEngine, ownerRefs)
-	var ey environment.EngineYard = map[string]environment.Engine{
-		environment.GoTplEngine: e,
+	ey := make(environment.EngineYard, len(c.engines))
+	for name, factory := range c.engines {
+		e := engine.NewOwnerRefEngine(factory(ownerRefs), ownerRefs)
+		e = newPostRenderEngine(e, r, c.postRenderFn)
+		ey[name] = e
 	}
 	env := &environment.Environment{
 		EngineYard: ey,
@@ -385,15 +649,3 @@ func (c manager) tillerRendererForCR(r *unstructured.Unstructured) *tiller.Relea
 	return tiller.NewReleaseServer(env, internalClientSet, false)
 }
 
-func releaseNameForCR(u *unstructured.Unstructured) string {
-	return fmt.Sprintf("%s-%s", u.GetName(), shortenUID(u.GetUID()))
-}
-
-func shortenUID(uid apitypes.UID) string {
-	u := uuid.Parse(string(uid))
-	uidBytes, err := u.MarshalBinary()
-	if err != nil {
-		return strings.Replace(string(uid), "-", "", -1)
-	}
-	return strings.ToLower(base36.EncodeBytes(uidBytes))
-}
@@ -15,22 +15,160 @@
 package release
 
 import (
+	"fmt"
+	"log"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/helm/pkg/kube"
 	"k8s.io/helm/pkg/storage"
+	"k8s.io/helm/pkg/storage/driver"
+
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/metrics"
 )
 
 // ManagerFactory can create new Helm release Managers given a custom resource.
 type ManagerFactory interface {
-	NewManager(*unstructured.Unstructured) Manager
+	NewManager(*unstructured.Unstructured) (Manager, error)
+
+	// RegisterEngine makes factory available to any chart whose Chart.yaml
+	// engine field names name, alongside the go template engine that is
+	// always registered under environment.GoTplEngine. It lets a downstream
+	// operator bring alternate templating (Jsonnet, CUE, Starlark, ...)
+	// while every engine still gets CR ownerRef injection.
+	RegisterEngine(name string, factory EngineFactory)
 }
 
 type managerFactory struct {
-	storageBackend   *storage.Storage
 	tillerKubeClient *kube.Client
 	chartDir         string
+	annotations      AnnotationSet
+	postRenderFn     PostRendererFn
+	metrics          *metrics.Metrics
+	helmV3RESTConfig *rest.Config
+	engines          map[string]EngineFactory
+	logger           logr.Logger
+	releaseNamer     ReleaseNamer
+}
+
+// ManagerFactoryOption configures a ManagerFactory returned by
+// NewManagerFactory.
+type ManagerFactoryOption func(*managerFactory)
+
+// WithAnnotations configures the ManagerFactory to honor ann instead of
+// DefaultAnnotationSet, letting a downstream operator register its own
+// annotation keys.
+func WithAnnotations(ann AnnotationSet) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.annotations = ann
+	}
+}
+
+// WithPostRendererFn configures the ManagerFactory to run every CR's
+// rendered manifests through the PostRenderer fn builds for it before the
+// manifests are handed to Tiller.
+func WithPostRendererFn(fn PostRendererFn) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.postRenderFn = fn
+	}
+}
+
+// WithMetrics configures the ManagerFactory to register its Prometheus
+// collectors against reg instead of controller-runtime's global
+// metrics.Registry, so vendors embedding this package can route metrics into
+// their own registerer.
+func WithMetrics(reg prometheus.Registerer) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.metrics = metrics.New(reg)
+	}
+}
+
+// WithLogger configures the ManagerFactory to record release events against
+// logger instead of the controller-runtime default logger named
+// "helm.release".
+func WithLogger(logger logr.Logger) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.logger = logger
+	}
+}
+
+// WithReleaseNamer configures the ManagerFactory to compute release names
+// with namer instead of DefaultReleaseNamer, letting a watch keep release
+// names under Helm's length limit or make them predictable across
+// re-creates of the CR. OverrideReleaseNameAnnotation on a CR always takes
+// precedence over namer.
+func WithReleaseNamer(namer ReleaseNamer) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.releaseNamer = namer
+	}
+}
+
+// WithHelmV3Backend configures the ManagerFactory to manage releases through
+// the Helm v3 action package, authenticating to the cluster with restConfig,
+// instead of the default Tiller-based backend. The Secrets storage driver is
+// used, matching Helm v3's own default.
+func WithHelmV3Backend(restConfig *rest.Config) ManagerFactoryOption {
+	return func(f *managerFactory) {
+		f.helmV3RESTConfig = restConfig
+	}
+}
+
+// NewManagerFactory returns a ManagerFactory that, by default, honors the
+// helm.sdk.operatorframework.io/* annotations in DefaultAnnotationSet, does
+// no post-rendering, and records Prometheus metrics against
+// metrics.Default. All three can be overridden with options.
+// tillerKubeClient is unused when WithHelmV3Backend is given and may be nil
+// in that case.
+func NewManagerFactory(tillerKubeClient *kube.Client, chartDir string, opts ...ManagerFactoryOption) ManagerFactory {
+	f := &managerFactory{
+		tillerKubeClient: tillerKubeClient,
+		chartDir:         chartDir,
+		annotations:      DefaultAnnotationSet,
+		metrics:          metrics.Default,
+		engines:          defaultEngines(),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+func (f *managerFactory) NewManager(u *unstructured.Unstructured) (Manager, error) {
+	if f.helmV3RESTConfig != nil {
+		return newActionManagerForCR(f.helmV3RESTConfig, f.chartDir, f.annotations, f.metrics, f.logger, f.releaseNamer, u), nil
+	}
+	storageBackend, err := f.storageBackendForNamespace(u.GetNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage backend: %s", err)
+	}
+	return newManagerForCR(storageBackend, f.tillerKubeClient, f.chartDir, f.annotations, f.postRenderFn, f.metrics, f.engines, f.logger, f.releaseNamer, u), nil
+}
+
+// RegisterEngine makes factory available to any chart whose Chart.yaml
+// engine field names name.
+func (f *managerFactory) RegisterEngine(name string, factory EngineFactory) {
+	f.engines[name] = factory
 }
 
-func (f *managerFactory) NewManager(u *unstructured.Unstructured) Manager {
-	return newManagerForCR(f.storageBackend, f.tillerKubeClient, f.chartDir, u)
+// storageBackendForNamespace returns a Helm storage backend backed by
+// Kubernetes Secrets in namespace, so release state travels with the CR
+// instead of living in one process-wide backend: deleting the CR's
+// namespace cleans up its release history, and RBAC can be scoped
+// per-namespace instead of requiring the operator to own Secrets in a
+// single Tiller namespace.
+func (f *managerFactory) storageBackendForNamespace(namespace string) (*storage.Storage, error) {
+	cfg, err := f.tillerKubeClient.ToRESTConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rest config: %s", err)
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %s", err)
+	}
+	d := driver.NewSecrets(clientset.CoreV1().Secrets(namespace))
+	d.Log = log.Printf
+	return storage.Init(d), nil
 }
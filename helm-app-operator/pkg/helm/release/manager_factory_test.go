@@ -0,0 +1,52 @@
+package release
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/helm/pkg/kube"
+	"k8s.io/kubernetes/pkg/kubectl/genericclioptions"
+)
+
+// fakeRESTClientGetter is the minimal genericclioptions.RESTClientGetter
+// needed to build a *kube.Client in tests, mirroring
+// pkg/helm/installer/client.go's clientGetter but backed by a static
+// rest.Config instead of a controller-runtime manager.
+type fakeRESTClientGetter struct {
+	cfg *rest.Config
+}
+
+var _ genericclioptions.RESTClientGetter = &fakeRESTClientGetter{}
+
+func (g *fakeRESTClientGetter) ToRESTConfig() (*rest.Config, error) { return g.cfg, nil }
+
+func (g *fakeRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	return nil, nil
+}
+
+func (g *fakeRESTClientGetter) ToRESTMapper() (meta.RESTMapper, error) { return nil, nil }
+
+func (g *fakeRESTClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig { return nil }
+
+// TestStorageBackendForNamespaceIsPerNamespace guards the behavior
+// storageBackendForNamespace's doc comment promises: every NewManager call builds a
+// fresh Secrets-backed storage.Storage scoped to the CR's own namespace,
+// rather than sharing one process-wide backend.
+func TestStorageBackendForNamespaceIsPerNamespace(t *testing.T) {
+	tillerKubeClient := kube.New(&fakeRESTClientGetter{cfg: &rest.Config{Host: "http://127.0.0.1:1"}})
+	f := &managerFactory{tillerKubeClient: tillerKubeClient}
+
+	a, err := f.storageBackendForNamespace("namespace-a")
+	require.NoError(t, err)
+	require.NotNil(t, a)
+
+	b, err := f.storageBackendForNamespace("namespace-b")
+	require.NoError(t, err)
+	require.NotNil(t, b)
+
+	require.True(t, a != b, "each namespace must get its own storage backend instance, not a shared process-wide one")
+}
@@ -0,0 +1,356 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helmrelease "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	rpb "k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/types"
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/metrics"
+)
+
+// actionManager is the Helm v3 counterpart to manager: it drives a release
+// through the action package (Install/Upgrade/Uninstall/Get) against a
+// Secrets storage driver, instead of Tiller's gRPC ReleaseServer. Selected
+// via WithHelmV3Backend.
+type actionManager struct {
+	restConfig *rest.Config
+	chartDir   string
+
+	namespace   string
+	releaseName string
+	gvk         schema.GroupVersionKind
+
+	spec        interface{}
+	status      *types.HelmAppStatus
+	installOpts InstallOptions
+	metrics     *metrics.Metrics
+	logger      logr.Logger
+
+	cfg    *action.Configuration
+	chart  *chart.Chart
+	values map[string]interface{}
+
+	isReleaseInstalled bool
+	isUpdateRequired   bool
+	deployedRelease    *helmrelease.Release
+
+	ownerRefs []metav1.OwnerReference
+}
+
+func newActionManagerForCR(restConfig *rest.Config, chartDir string, annotations AnnotationSet, mtx *metrics.Metrics, logger logr.Logger, namer ReleaseNamer, u *unstructured.Unstructured) Manager {
+	if mtx == nil {
+		mtx = metrics.Default
+	}
+	if logger == nil {
+		logger = defaultLog
+	}
+	if namer == nil {
+		namer = DefaultReleaseNamer{}
+	}
+	releaseName := GetReleaseName(namer, u)
+	controllerRef := metav1.NewControllerRef(u, u.GroupVersionKind())
+	return &actionManager{
+		restConfig:  restConfig,
+		chartDir:    chartDir,
+		namespace:   u.GetNamespace(),
+		releaseName: releaseName,
+		gvk:         u.GroupVersionKind(),
+		spec:        u.Object["spec"],
+		status:      types.StatusFor(u),
+		installOpts: annotations.optionsFor(u),
+		metrics:     mtx,
+		logger:      logger.WithValues("release", releaseName, "namespace", u.GetNamespace()),
+		ownerRefs:   []metav1.OwnerReference{*controllerRef},
+	}
+}
+
+// Sync is a no-op for the action backend: unlike Tiller, action.Configuration
+// talks to the Secrets storage driver directly on every call, so there's no
+// separate in-memory release history to reconcile against the CR's status.
+func (c *actionManager) Sync(ctx context.Context) error {
+	return nil
+}
+
+// GetReleaseName returns the release name for the release managed by this
+// release manager.
+func (c *actionManager) GetReleaseName() string {
+	return c.releaseName
+}
+
+// PrepareRelease loads the chart and values for the release and updates
+// state that is used to determine what release steps should be executed.
+func (c *actionManager) PrepareRelease(ctx context.Context) error {
+	cfg := &action.Configuration{}
+	if err := cfg.Init(&restConfigGetter{c.restConfig}, c.namespace, "secrets", log.Printf); err != nil {
+		return fmt.Errorf("failed to initialize Helm v3 action configuration: %s", err)
+	}
+	c.cfg = cfg
+
+	chrt, err := loader.LoadDir(c.chartDir)
+	if err != nil {
+		return fmt.Errorf("failed to load chart: %s", err)
+	}
+	c.chart = chrt
+
+	values, _ := c.spec.(map[string]interface{})
+	c.values = values
+
+	deployedRelease, err := action.NewGet(c.cfg).Run(c.releaseName)
+	if err == driver.ErrReleaseNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve deployed release info: %s", err)
+	}
+	c.deployedRelease = deployedRelease
+	c.isReleaseInstalled = true
+
+	// Do a dry run upgrade to see if we need to update the release or just
+	// reconcile resources.
+	dryRunUpgrade := action.NewUpgrade(c.cfg)
+	dryRunUpgrade.DryRun = true
+	dryRunUpgrade.PostRenderer = newOwnerRefPostRenderer(c.ownerRefs)
+	dryRunRelease, err := dryRunUpgrade.Run(c.releaseName, c.chart, c.values)
+	if err != nil {
+		return fmt.Errorf("failed to execute dry run update: %s", err)
+	}
+	if c.deployedRelease.Manifest != dryRunRelease.Manifest {
+		c.isUpdateRequired = true
+	}
+
+	return nil
+}
+
+// InstallRelease installs a new Helm release.
+func (c *actionManager) InstallRelease(ctx context.Context) (rel Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionInstall, start, err) }(time.Now())
+
+	install := action.NewInstall(c.cfg)
+	install.ReleaseName = c.releaseName
+	install.Namespace = c.namespace
+	install.Timeout = time.Duration(c.installOpts.InstallTimeout) * time.Second
+	install.PostRenderer = newOwnerRefPostRenderer(c.ownerRefs)
+
+	installedRelease, err := install.Run(c.chart, c.values)
+	if err != nil {
+		c.logger.Error(err, "Failed to install release")
+		return nil, err
+	}
+	c.logger.Info("Installed release", "revision", installedRelease.Version)
+	return wrapActionRelease(installedRelease), nil
+}
+
+// UpdateRelease updates an existing Helm release.
+func (c *actionManager) UpdateRelease(ctx context.Context) (previous Release, updated Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionUpgrade, start, err) }(time.Now())
+
+	upgrade := action.NewUpgrade(c.cfg)
+	upgrade.Force = c.installOpts.UpgradeForce
+	upgrade.Timeout = time.Duration(c.installOpts.UpgradeTimeout) * time.Second
+	upgrade.PostRenderer = newOwnerRefPostRenderer(c.ownerRefs)
+
+	updatedRelease, err := upgrade.Run(c.releaseName, c.chart, c.values)
+	if err != nil {
+		c.logger.Error(err, "Failed to update release")
+		return nil, nil, err
+	}
+	c.logger.Info("Updated release", "revision", updatedRelease.Version)
+	return wrapActionRelease(c.deployedRelease), wrapActionRelease(updatedRelease), nil
+}
+
+// ReleaseStatus returns the Tiller-compatible status code of this release's
+// most recent revision, by version, and the description Helm recorded for it
+// (the failure reason, when the code is FAILED). The v3 storage driver has
+// its own status-code type, so this maps it onto rpb.Status_Code to match
+// the Manager interface's backend-neutral contract.
+func (c *actionManager) ReleaseStatus(ctx context.Context) (*rpb.Status, string, error) {
+	history, err := c.cfg.Releases.History(c.releaseName)
+	if err != nil {
+		if err == driver.ErrReleaseNotFound {
+			return &rpb.Status{Code: rpb.Status_UNKNOWN}, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get release history: %s", err)
+	}
+	if len(history) == 0 {
+		return &rpb.Status{Code: rpb.Status_UNKNOWN}, "", nil
+	}
+
+	latest := history[0]
+	for _, rel := range history[1:] {
+		if rel.Version > latest.Version {
+			latest = rel
+		}
+	}
+	return &rpb.Status{Code: actionStatusCode(latest.Info.Status)}, latest.Info.Description, nil
+}
+
+// actionStatusCode maps a Helm v3 release status onto its Tiller (Helm v2)
+// equivalent, for backends (e.g. metrics, CR status conditions) written
+// against the v2 proto's Status_Code.
+func actionStatusCode(s helmrelease.Status) rpb.Status_Code {
+	switch s {
+	case helmrelease.StatusDeployed:
+		return rpb.Status_DEPLOYED
+	case helmrelease.StatusFailed:
+		return rpb.Status_FAILED
+	case helmrelease.StatusUninstalled:
+		return rpb.Status_DELETED
+	case helmrelease.StatusUninstalling:
+		return rpb.Status_DELETING
+	case helmrelease.StatusSuperseded:
+		return rpb.Status_SUPERSEDED
+	case helmrelease.StatusPendingInstall:
+		return rpb.Status_PENDING_INSTALL
+	case helmrelease.StatusPendingUpgrade:
+		return rpb.Status_PENDING_UPGRADE
+	case helmrelease.StatusPendingRollback:
+		return rpb.Status_PENDING_ROLLBACK
+	default:
+		return rpb.Status_UNKNOWN
+	}
+}
+
+// ReconcileRelease is a no-op for the action backend: unlike the Tiller
+// backend, it does not correct drift in live resources. They are reapplied
+// only when the caller runs UpdateRelease, which it does when PrepareRelease
+// finds the rendered manifest differs from the deployed one.
+func (c *actionManager) ReconcileRelease(ctx context.Context) (rel Release, diff string, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionReconcile, start, err) }(time.Now())
+	return wrapActionRelease(c.deployedRelease), "", nil
+}
+
+// UninstallRelease uninstalls the Helm release. If no release exists,
+// ErrNotFound is returned.
+func (c *actionManager) UninstallRelease(ctx context.Context) (rel Release, err error) {
+	defer func(start time.Time) { c.metrics.ObserveAction(c.gvk, metrics.ActionUninstall, start, err) }(time.Now())
+
+	resp, err := action.NewUninstall(c.cfg).Run(c.releaseName)
+	if err == driver.ErrReleaseNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		c.logger.Error(err, "Failed to uninstall release")
+		return nil, err
+	}
+	c.logger.Info("Uninstalled release", "revision", resp.Release.Version)
+	return wrapActionRelease(resp.Release), nil
+}
+
+// IsReleaseInstalled returns whether a release is installed. This method
+// must be called only after PrepareRelease has been called.
+func (c *actionManager) IsReleaseInstalled() bool {
+	return c.isReleaseInstalled
+}
+
+// IsUpdateRequired returns whether a release needs to be updated. This
+// method must be called only after PrepareRelease has been called.
+func (c *actionManager) IsUpdateRequired() bool {
+	return c.isUpdateRequired
+}
+
+// UninstallWaitEnabled reports whether the CR this manager was created for
+// carries the uninstall-wait annotation.
+func (c *actionManager) UninstallWaitEnabled() bool {
+	return c.installOpts.UninstallWait
+}
+
+// GetLogger returns the logger this manager records release events against.
+func (c *actionManager) GetLogger() logr.Logger {
+	return c.logger
+}
+
+// AwaitingDependentResourceRemoval reports whether any resource listed in
+// manifest is still present in the cluster, so a caller honoring
+// uninstall-wait knows whether it's safe to remove its finalizer.
+func (c *actionManager) AwaitingDependentResourceRemoval(ctx context.Context, manifest string) (bool, error) {
+	infos, err := c.cfg.KubeClient.Build(strings.NewReader(manifest), false)
+	if err != nil {
+		return false, fmt.Errorf("failed building unstructured objects for uninstalled release: %s", err)
+	}
+
+	remaining := false
+	err = infos.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return err
+		}
+		helper := resource.NewHelper(info.Client, info.Mapping)
+		if _, getErr := helper.Get(info.Namespace, info.Name); getErr == nil {
+			remaining = true
+		} else if !apierrors.IsNotFound(getErr) {
+			return getErr
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed checking for remaining dependent resources: %s", err)
+	}
+	return remaining, nil
+}
+
+// restConfigGetter adapts a *rest.Config to genericclioptions.RESTClientGetter
+// so action.Configuration.Init can build its Kubernetes clients without a
+// kubeconfig file on disk.
+type restConfigGetter struct {
+	cfg *rest.Config
+}
+
+func (g *restConfigGetter) ToRESTConfig() (*rest.Config, error) {
+	return g.cfg, nil
+}
+
+func (g *restConfigGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(g.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(dc), nil
+}
+
+func (g *restConfigGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	dc, err := g.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	return restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(dc), dc), nil
+}
+
+func (g *restConfigGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return nil
+}
@@ -15,8 +15,11 @@
 package release
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"strings"
+	"text/template"
 
 	"github.com/martinlindhe/base36"
 	"github.com/pborman/uuid"
@@ -25,17 +28,101 @@ import (
 	apitypes "k8s.io/apimachinery/pkg/types"
 )
 
-// GetReleaseName returns a cluster-wide unique release name for the passed in
-// object.
-func GetReleaseName(r *unstructured.Unstructured) string {
-	return fmt.Sprintf("%s-%s", r.GetName(), shortenUID(r.GetUID()))
+// maxReleaseNameLength is Helm's own limit on a release name. Resources Helm
+// derives a name from (e.g. "<release>-<chart>") must still fit within
+// Kubernetes' 63-char DNS label limit, so names a ReleaseNamer produces
+// longer than this are truncated.
+const maxReleaseNameLength = 53
+
+// OverrideReleaseNameAnnotation, when set on a watched CR, is used verbatim
+// as the release name instead of consulting the Manager's ReleaseNamer,
+// letting a CR adopt a release installed out-of-band under a known name.
+const OverrideReleaseNameAnnotation = "helm.sdk.operatorframework.io/release-name"
+
+// ReleaseNamer computes the Tiller/Helm release name for a CR. NewManagerFactory
+// defaults to DefaultReleaseNamer, reproducing the operator's original
+// <cr-name>-<base36(uid)> scheme; WithReleaseNamer lets a watch install a
+// different one, e.g. a name that survives the CR being deleted and
+// re-created, or one short enough to avoid Helm's release-name limit.
+//
+// Whatever name is computed, PrepareRelease adopts any pre-existing release
+// already deployed under it: it's looked up from storageBackend by name
+// alone, with no notion of which controller created it, so a release
+// installed out-of-band under a name a ReleaseNamer or
+// OverrideReleaseNameAnnotation reproduces is treated exactly like one this
+// operator installed. Its resources get ownerRefs on the next UpdateRelease,
+// which follows because PrepareRelease's dry-run renders them with ownerRefs
+// and so finds the deployed manifest out of date.
+type ReleaseNamer interface {
+	Name(u *unstructured.Unstructured) string
+}
+
+// GetReleaseName returns the release name for u: OverrideReleaseNameAnnotation
+// verbatim if set, otherwise namer's result, truncated to
+// maxReleaseNameLength with a deterministic short hash appended when
+// truncation occurs, so two CRs whose namer output collides after
+// truncation still don't share a release name.
+func GetReleaseName(namer ReleaseNamer, u *unstructured.Unstructured) string {
+	if override := u.GetAnnotations()[OverrideReleaseNameAnnotation]; override != "" {
+		return override
+	}
+	return truncateReleaseName(namer.Name(u))
+}
+
+func truncateReleaseName(name string) string {
+	if len(name) <= maxReleaseNameLength {
+		return name
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:8]
+	return fmt.Sprintf("%s-%s", name[:maxReleaseNameLength-len(hash)-1], hash)
+}
+
+// DefaultReleaseNamer is the ReleaseNamer used when a watch doesn't
+// configure its own. It reproduces the operator's original scheme: the CR's
+// name plus a base36-encoded UID, unique cluster-wide without requiring a
+// lookup.
+type DefaultReleaseNamer struct{}
+
+// Name returns "<cr-name>-<base36(uid)>".
+func (DefaultReleaseNamer) Name(u *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s-%s", u.GetName(), shortenUID(u.GetUID()))
 }
 
 func shortenUID(uid apitypes.UID) string {
-	u := uuid.Parse(string(uid))
-	uidBytes, err := u.MarshalBinary()
+	parsed := uuid.Parse(string(uid))
+	uidBytes, err := parsed.MarshalBinary()
 	if err != nil {
 		return strings.Replace(string(uid), "-", "", -1)
 	}
 	return strings.ToLower(base36.EncodeBytes(uidBytes))
 }
+
+// TemplateReleaseNamer computes a release name by executing a Go template,
+// configured via watches.yaml's releaseName field (e.g.
+// "{{ .metadata.namespace }}-{{ .metadata.name }}"), against the CR's
+// unstructured content.
+type TemplateReleaseNamer struct {
+	tmpl *template.Template
+}
+
+// NewTemplateReleaseNamer parses expr as a Go template and returns a
+// ReleaseNamer that executes it against a CR's unstructured content on every
+// call to Name.
+func NewTemplateReleaseNamer(expr string) (*TemplateReleaseNamer, error) {
+	tmpl, err := template.New("releaseName").Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse releaseName template %q: %s", expr, err)
+	}
+	return &TemplateReleaseNamer{tmpl: tmpl}, nil
+}
+
+// Name executes the template against u.Object, falling back to
+// DefaultReleaseNamer if execution fails.
+func (n *TemplateReleaseNamer) Name(u *unstructured.Unstructured) string {
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, u.Object); err != nil {
+		defaultLog.Error(err, "Failed to execute releaseName template, falling back to default naming", "name", u.GetName(), "namespace", u.GetNamespace())
+		return DefaultReleaseNamer{}.Name(u)
+	}
+	return buf.String()
+}
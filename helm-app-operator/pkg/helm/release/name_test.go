@@ -0,0 +1,92 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newTestCR(name string, annotations map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetName(name)
+	u.SetNamespace("test-namespace")
+	u.SetUID("9f4c3b1a-0000-0000-0000-000000000000")
+	u.SetAnnotations(annotations)
+	return u
+}
+
+func TestTruncateReleaseName(t *testing.T) {
+	atLimit := strings.Repeat("a", maxReleaseNameLength)
+	require.Equal(t, atLimit, truncateReleaseName(atLimit))
+
+	overLimitA := strings.Repeat("a", maxReleaseNameLength+1)
+	overLimitB := strings.Repeat("a", maxReleaseNameLength-1) + "bb"
+	truncatedA := truncateReleaseName(overLimitA)
+	truncatedB := truncateReleaseName(overLimitB)
+	require.Len(t, truncatedA, maxReleaseNameLength)
+	require.Len(t, truncatedB, maxReleaseNameLength)
+	require.True(t, strings.HasPrefix(truncatedA, strings.Repeat("a", maxReleaseNameLength-9)))
+	require.NotEqual(t, truncatedA, truncatedB, "two overlong names sharing a common prefix must not collide after truncation")
+}
+
+func TestGetReleaseNameOverrideAnnotationTakesPrecedence(t *testing.T) {
+	u := newTestCR("my-app", map[string]string{OverrideReleaseNameAnnotation: "adopted-release"})
+	require.Equal(t, "adopted-release", GetReleaseName(DefaultReleaseNamer{}, u))
+}
+
+func TestGetReleaseNameFallsBackToNamer(t *testing.T) {
+	u := newTestCR("my-app", nil)
+	require.Equal(t, DefaultReleaseNamer{}.Name(u), GetReleaseName(DefaultReleaseNamer{}, u))
+}
+
+func TestDefaultReleaseNamer(t *testing.T) {
+	u := newTestCR("my-app", nil)
+	name := DefaultReleaseNamer{}.Name(u)
+	require.True(t, strings.HasPrefix(name, "my-app-"))
+}
+
+func TestTemplateReleaseNamer(t *testing.T) {
+	namer, err := NewTemplateReleaseNamer("{{ .metadata.namespace }}-{{ .metadata.name }}")
+	require.NoError(t, err)
+
+	u := newTestCR("my-app", nil)
+	require.Equal(t, "test-namespace-my-app", namer.Name(u))
+}
+
+func TestTemplateReleaseNamerFallsBackOnExecutionFailure(t *testing.T) {
+	// .metadata.name is a string, so indexing a field on it fails at
+	// execution time rather than at parse time.
+	namer, err := NewTemplateReleaseNamer("{{ .metadata.name.nonexistent }}")
+	require.NoError(t, err)
+
+	u := newTestCR("my-app", nil)
+	require.Equal(t, DefaultReleaseNamer{}.Name(u), namer.Name(u))
+}
+
+func TestNewTemplateReleaseNamerParseError(t *testing.T) {
+	_, err := NewTemplateReleaseNamer("{{ .metadata.name")
+	require.Error(t, err)
+}
+
+func TestShortenUID(t *testing.T) {
+	u := newTestCR("my-app", nil)
+	shortened := shortenUID(u.GetUID())
+	require.NotEmpty(t, shortened)
+	require.Equal(t, shortened, shortenUID(u.GetUID()), "shortenUID must be deterministic for the same UID")
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"bytes"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+// ownerRefPostRenderer is the Helm v3 successor to engine.OwnerRefEngine: v3
+// has no Render-wrapping extension point, but it does let action.Install and
+// action.Upgrade run every manifest through a postrender.PostRenderer before
+// applying it, which is where owner-ref injection now happens instead.
+type ownerRefPostRenderer struct {
+	refs []metav1.OwnerReference
+}
+
+// assert interface
+var _ postrender.PostRenderer = &ownerRefPostRenderer{}
+
+// Run adds refs to every document in renderedManifests.
+func (p *ownerRefPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	const documentSeparator = "---\n"
+	var out bytes.Buffer
+
+	for _, manifest := range releaseutil.SplitManifests(renderedManifests.String()) {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+			return nil, fmt.Errorf("error parsing rendered template to add ownerrefs: %s", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+
+		u := &unstructured.Unstructured{Object: obj}
+		u.SetOwnerReferences(p.refs)
+
+		withOwner, err := yaml.Marshal(u.Object)
+		if err != nil {
+			return nil, fmt.Errorf("error writing the document with ownerrefs: %s", err)
+		}
+		out.Write(withOwner)
+		out.WriteString(documentSeparator)
+	}
+
+	return &out, nil
+}
+
+// newOwnerRefPostRenderer builds a postrender.PostRenderer that stamps refs
+// onto every resource the Helm v3 action backend installs or upgrades.
+func newOwnerRefPostRenderer(refs []metav1.OwnerReference) postrender.PostRenderer {
+	return &ownerRefPostRenderer{refs: refs}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/chartutil"
+	cpb "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/tiller/environment"
+)
+
+// PostRenderer mutates a chart's rendered manifest files before they are
+// handed to Tiller, e.g. to inject sidecars, apply kustomize overlays, stamp
+// org-mandated labels/annotations, or strip disallowed kinds.
+type PostRenderer interface {
+	Run(rendered map[string]string) (map[string]string, error)
+}
+
+// PostRendererFn builds the PostRenderer to run a CR's rendered manifests
+// through, given the values used to render the chart. Returning a nil
+// PostRenderer (with a nil error) skips post-rendering for that release.
+type PostRendererFn func(ctx context.Context, obj *unstructured.Unstructured, vals map[string]interface{}) (PostRenderer, error)
+
+// postRenderEngine wraps a tiller Render engine, running its output through
+// fn's PostRenderer before returning it. It is the successor to the
+// owner-reference-only wrapping in engine.OwnerRefEngine: owner-ref injection
+// becomes just one link in the chain, composed ahead of postRenderEngine by
+// the caller.
+type postRenderEngine struct {
+	environment.Engine
+	obj *unstructured.Unstructured
+	fn  PostRendererFn
+}
+
+// assert interface
+var _ environment.Engine = &postRenderEngine{}
+
+// Render proxies to the wrapped Render engine and then, if fn is set, runs
+// the result through the PostRenderer fn returns for obj and values.
+func (e *postRenderEngine) Render(chart *cpb.Chart, values chartutil.Values) (map[string]string, error) {
+	rendered, err := e.Engine.Render(chart, values)
+	if err != nil {
+		return nil, err
+	}
+	if e.fn == nil {
+		return rendered, nil
+	}
+
+	postRenderer, err := e.fn(context.TODO(), e.obj, map[string]interface{}(values))
+	if err != nil {
+		return nil, err
+	}
+	if postRenderer == nil {
+		return rendered, nil
+	}
+	return postRenderer.Run(rendered)
+}
+
+// newPostRenderEngine wraps baseEngine so every Render call is post-processed
+// by the PostRenderer fn builds for obj. If fn is nil, baseEngine is returned
+// unwrapped.
+func newPostRenderEngine(baseEngine environment.Engine, obj *unstructured.Unstructured, fn PostRendererFn) environment.Engine {
+	if fn == nil {
+		return baseEngine
+	}
+	return &postRenderEngine{
+		Engine: baseEngine,
+		obj:    obj,
+		fn:     fn,
+	}
+}
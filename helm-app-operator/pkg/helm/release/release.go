@@ -0,0 +1,129 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	helmv3release "helm.sh/helm/v3/pkg/release"
+	rpb "k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/operator-framework/helm-app-operator-kit/helm-app-operator/pkg/helm/internal/types"
+)
+
+// Release is a backend-neutral view of an installed Helm release: exactly
+// what Manager's callers need, regardless of whether the Tiller (Helm v2) or
+// action (Helm v3) backend produced it.
+type Release interface {
+	GetManifest() string
+	GetNotes() string
+	GetChartVersion() string
+	// Info returns a snapshot of the release suitable for embedding in a
+	// HelmAppCondition.
+	Info() *types.ReleaseInfo
+}
+
+// tillerRelease adapts a Tiller *rpb.Release to Release.
+type tillerRelease struct {
+	rel *rpb.Release
+}
+
+// assert interface
+var _ Release = tillerRelease{}
+
+func (r tillerRelease) GetManifest() string {
+	return r.rel.GetManifest()
+}
+
+func (r tillerRelease) GetNotes() string {
+	return r.rel.GetInfo().GetStatus().GetNotes()
+}
+
+func (r tillerRelease) GetChartVersion() string {
+	return r.rel.GetChart().GetMetadata().GetVersion()
+}
+
+func (r tillerRelease) Info() *types.ReleaseInfo {
+	if r.rel == nil {
+		return nil
+	}
+	return &types.ReleaseInfo{
+		Name:         r.rel.GetName(),
+		Manifest:     r.rel.GetManifest(),
+		Notes:        r.rel.GetInfo().GetStatus().GetNotes(),
+		ChartName:    r.rel.GetChart().GetMetadata().GetName(),
+		ChartVersion: r.rel.GetChart().GetMetadata().GetVersion(),
+	}
+}
+
+// wrapTillerRelease adapts rel to Release, returning a nil Release if rel is
+// nil so callers can keep comparing against nil without a type-assertion
+// footgun.
+func wrapTillerRelease(rel *rpb.Release) Release {
+	if rel == nil {
+		return nil
+	}
+	return tillerRelease{rel: rel}
+}
+
+// actionRelease adapts a Helm v3 *release.Release to Release.
+type actionRelease struct {
+	rel *helmv3release.Release
+}
+
+// assert interface
+var _ Release = actionRelease{}
+
+func (r actionRelease) GetManifest() string {
+	return r.rel.Manifest
+}
+
+func (r actionRelease) GetNotes() string {
+	if r.rel.Info == nil {
+		return ""
+	}
+	return r.rel.Info.Notes
+}
+
+func (r actionRelease) GetChartVersion() string {
+	if r.rel.Chart == nil || r.rel.Chart.Metadata == nil {
+		return ""
+	}
+	return r.rel.Chart.Metadata.Version
+}
+
+func (r actionRelease) Info() *types.ReleaseInfo {
+	if r.rel == nil {
+		return nil
+	}
+	info := &types.ReleaseInfo{
+		Name:     r.rel.Name,
+		Manifest: r.rel.Manifest,
+		Notes:    r.GetNotes(),
+	}
+	if r.rel.Chart != nil && r.rel.Chart.Metadata != nil {
+		info.ChartName = r.rel.Chart.Metadata.Name
+		info.ChartVersion = r.rel.Chart.Metadata.Version
+	}
+	return info
+}
+
+// wrapActionRelease adapts rel to Release, returning a nil Release if rel is
+// nil so callers can keep comparing against nil without a type-assertion
+// footgun.
+func wrapActionRelease(rel *helmv3release.Release) Release {
+	if rel == nil {
+		return nil
+	}
+	return actionRelease{rel: rel}
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/helm/pkg/kube"
+)
+
+// defaultWatchRegistryPollInterval is how often WatchRegistry re-reads its
+// watches file looking for changes, absent an explicit interval.
+const defaultWatchRegistryPollInterval = 10 * time.Second
+
+// DynamicWatchesEnvVar is the environment variable for a YAML watches file,
+// in the same format as HelmChartWatchesEnvVar, that should be managed by a
+// WatchRegistry instead of statically at startup. GVKs listed here can be
+// added or removed by editing the file on disk, without restarting the
+// operator. There is no default file for this path: it is opt-in, and
+// deliberately separate from HelmChartWatchesEnvVar so the two watch
+// mechanisms never fight over the same GVK.
+const DynamicWatchesEnvVar = "DYNAMIC_HELM_CHART_WATCHES"
+
+// WatchEventType is the kind of change a WatchRegistry reports.
+type WatchEventType string
+
+const (
+	// WatchAdded indicates a GVK newly appeared in the watches file.
+	WatchAdded WatchEventType = "Added"
+	// WatchRemoved indicates a GVK present in the previous generation of the
+	// watches file is no longer there.
+	WatchRemoved WatchEventType = "Removed"
+)
+
+// WatchEvent reports that GVK started or stopped being watched after the
+// watches file changed on disk. Factory is nil for WatchRemoved.
+type WatchEvent struct {
+	Type    WatchEventType
+	GVK     schema.GroupVersionKind
+	Factory ManagerFactory
+}
+
+// WatchRegistry polls the watches file named by path for changes, comparing
+// its contents by hash so unrelated file touches (same bytes, new mtime)
+// don't spuriously reload, and emits a WatchEvent on Events() for every GVK
+// that starts or stops being watched. This lets a long-running operator
+// manage new chart kinds, or retire old ones, without restarting the pod.
+type WatchRegistry struct {
+	tillerKubeClient *kube.Client
+	path             string
+	pollInterval     time.Duration
+
+	events  chan WatchEvent
+	current map[schema.GroupVersionKind]struct{}
+	lastSum [sha256.Size]byte
+}
+
+// NewWatchRegistry returns a WatchRegistry that polls the watches file at
+// path every pollInterval (defaultWatchRegistryPollInterval if zero). It
+// does not read the file or emit any events until Start is called.
+func NewWatchRegistry(tillerKubeClient *kube.Client, path string, pollInterval time.Duration) *WatchRegistry {
+	if pollInterval <= 0 {
+		pollInterval = defaultWatchRegistryPollInterval
+	}
+	return &WatchRegistry{
+		tillerKubeClient: tillerKubeClient,
+		path:             path,
+		pollInterval:     pollInterval,
+		events:           make(chan WatchEvent),
+		current:          map[schema.GroupVersionKind]struct{}{},
+	}
+}
+
+// Events returns the channel WatchEvents are sent on. It is closed once stop
+// closes and the poll loop exits.
+func (wr *WatchRegistry) Events() <-chan WatchEvent {
+	return wr.events
+}
+
+// Start loads the watches file once, synchronously emitting a WatchAdded
+// event for every GVK it finds, then begins polling for changes in the
+// background until stop closes.
+func (wr *WatchRegistry) Start(stop <-chan struct{}) error {
+	if err := wr.reload(); err != nil {
+		return err
+	}
+	go wr.pollLoop(stop)
+	return nil
+}
+
+func (wr *WatchRegistry) pollLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(wr.pollInterval)
+	defer ticker.Stop()
+	defer close(wr.events)
+	for {
+		select {
+		case <-ticker.C:
+			if err := wr.reload(); err != nil {
+				log.Printf("failed to reload watches file %s: %s", wr.path, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reload re-reads wr.path and diffs its GVKs against wr.current, sending a
+// WatchEvent for each addition or removal. It is a no-op if the file's
+// contents haven't changed since the last reload.
+func (wr *WatchRegistry) reload() error {
+	b, err := ioutil.ReadFile(wr.path)
+	if err != nil {
+		return fmt.Errorf("failed to read watches file: %s", err)
+	}
+	sum := sha256.Sum256(b)
+	if sum == wr.lastSum {
+		return nil
+	}
+
+	watches := []watch{}
+	if err := yaml.Unmarshal(b, &watches); err != nil {
+		return fmt.Errorf("failed to unmarshal watches file: %s", err)
+	}
+
+	next := map[schema.GroupVersionKind]struct{}{}
+	for _, w := range watches {
+		gvk := schema.GroupVersionKind{Group: w.Group, Version: w.Version, Kind: w.Kind}
+		if err := verifyGVK(gvk); err != nil {
+			return fmt.Errorf("invalid GVK: %s: %s", gvk, err)
+		}
+		next[gvk] = struct{}{}
+
+		if _, ok := wr.current[gvk]; ok {
+			continue
+		}
+
+		var opts []ManagerFactoryOption
+		if w.ReleaseName != "" {
+			namer, err := NewTemplateReleaseNamer(w.ReleaseName)
+			if err != nil {
+				return fmt.Errorf("invalid releaseName for %s: %s", gvk, err)
+			}
+			opts = append(opts, WithReleaseNamer(namer))
+		}
+		chartDir := w.Chart
+		if w.Repo != "" {
+			chartDir, err = resolveRepoChartDir(w.Repo, w.Chart, w.ChartVersion)
+			if err != nil {
+				return fmt.Errorf("failed to resolve chart for %s: %s", gvk, err)
+			}
+		}
+		wr.events <- WatchEvent{
+			Type:    WatchAdded,
+			GVK:     gvk,
+			Factory: NewManagerFactory(wr.tillerKubeClient, chartDir, opts...),
+		}
+	}
+
+	for gvk := range wr.current {
+		if _, ok := next[gvk]; !ok {
+			wr.events <- WatchEvent{Type: WatchRemoved, GVK: gvk}
+		}
+	}
+
+	wr.current = next
+	wr.lastSum = sum
+	return nil
+}